@@ -29,7 +29,9 @@ const ChatBody: React.FC<ChatBodyProps> = ({ chatID }) => {
             setConn(ws);
     
             ws.onmessage = (event) => {
-                const newMessage: Message = JSON.parse(event.data);
+                const frame = JSON.parse(event.data);
+                if (frame.type !== "message") return;
+                const newMessage: Message = frame.payload;
                 setMessages((prev) => [...prev, newMessage]); // Dynamically append new messages
             };
     
@@ -48,7 +50,7 @@ const ChatBody: React.FC<ChatBodyProps> = ({ chatID }) => {
                 username: user?.username,
             };
 
-            conn.send(JSON.stringify(message));
+            conn.send(JSON.stringify({ v: 1, type: "message", id: crypto.randomUUID(), payload: { content: message.content } }));
             textareaRef.current.value = ""; // Clear textarea
             setMessages((prev) => [...prev, { ...message, type: "self" }]);
         }
@@ -70,4 +72,4 @@ const ChatBody: React.FC<ChatBodyProps> = ({ chatID }) => {
     );
 };
 
-export default ChatBody;
\ No newline at end of file
+export default ChatBody;
\ No newline at end of file
@@ -51,6 +51,7 @@ const AuthContextProvider = ({ children }: { children: React.ReactNode }) => {
             if (res.ok) {
                 const data = await res.json();
                 localStorage.setItem("jwt", data.accessToken); // Store the new access token
+                localStorage.setItem("refreshToken", data.refreshToken); // The old refresh token no longer works
                 return data.accessToken;
             } else if (res.status === 429) {
                 console.warn("Rate limit exceeded. Retrying...");
@@ -114,8 +115,22 @@ const AuthContextProvider = ({ children }: { children: React.ReactNode }) => {
     };
 
     // Logout function for user-initiated logouts
-    const logout = () => {
+    const logout = async () => {
         console.info("Logging out...");
+        const token = localStorage.getItem("jwt");
+        if (token) {
+            try {
+                // Revoke the session so its tokens stop working on the server
+                await fetch(`${API_URL}/logout`, {
+                    method: "POST",
+                    headers: {
+                        Authorization: `Bearer ${token}`,
+                    },
+                });
+            } catch (error) {
+                console.error("Error revoking session:", error);
+            }
+        }
         handleTokenError("User logged out.");
     };
 
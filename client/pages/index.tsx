@@ -123,8 +123,12 @@ const Index = () => {
     
             ws.onmessage = (event) => {
                 try {
-                    const newMessage = JSON.parse(event.data);
-                    setMessages((prev) => [...prev, newMessage]);
+                    const frame = JSON.parse(event.data);
+                    if (frame.type === "message") {
+                        setMessages((prev) => [...prev, frame.payload]);
+                    } else if (frame.type === "error") {
+                        console.error("WebSocket error frame:", frame.payload);
+                    }
                 } catch (error) {
                     console.error("Error parsing WebSocket message:", error);
                 }
@@ -277,7 +281,7 @@ const Index = () => {
 
             if (!res.ok) throw new Error("Failed to fetch chat messages.");
             const data = await res.json();
-            setMessages(data || []);
+            setMessages(data?.messages || []);
         } catch (error) {
             console.error("Error fetching chat messages:", error);
         }
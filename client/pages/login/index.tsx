@@ -44,7 +44,8 @@ const IndexPage = () => {
 
       if (res.ok) {
         localStorage.setItem("user_info", JSON.stringify({ id: data.id, username: data.username }));
-        localStorage.setItem("jwt", data.token);
+        localStorage.setItem("jwt", data.accessToken);
+        localStorage.setItem("refreshToken", data.refreshToken);
 
         setUser({ id: data.id, username: data.username });
         setAuthenticated(true);
@@ -62,6 +62,7 @@ const refreshToken = async (router: NextRouter): Promise<string | null> => {
         if (res.ok) {
             const data = await res.json();
             localStorage.setItem("jwt", data.accessToken); // Store the new access token
+            localStorage.setItem("refreshToken", data.refreshToken); // The old refresh token no longer works
             return data.accessToken;
         } else if (res.status === 429) {
             console.warn("Rate limit exceeded. Retrying after 1 minute...");
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"server/config"
 	"server/db"
+	"server/internal/linkpreview"
+	"server/internal/storage"
 	"server/internal/user"
 	"server/internal/ws"
 	"server/router"
+	"server/util"
+	"time"
 )
 
 func main() {
@@ -23,23 +29,47 @@ func main() {
 		log.Fatalf("Could not initialize database connection: %s", err)
 	}
 
+	// Set up file storage for attachments and avatars
+	store, err := storage.New()
+	if err != nil {
+		log.Fatalf("Failed to set up file storage: %v", err)
+	}
+
+	// Set up the issuer of access tokens
+	tokens, err := util.NewTokenIssuerFromConfig()
+	if err != nil {
+		log.Fatalf("Failed to set up token issuer: %v", err)
+	}
+
 	// Set up user repository, service, and handler
 	userRep := user.NewRepository(dbConn.GetDB())
-	userSvc := user.NewService(userRep)
+	userSvc := user.NewService(userRep, store, tokens)
 	userHandler := user.NewHandler(userSvc)
 
+	// Keep rejecting access tokens revoked before a restart
+	if err := userSvc.LoadRevocations(context.Background()); err != nil {
+		log.Fatalf("Failed to load token revocations: %v", err)
+	}
+	// Pick up tokens revoked through other server instances
+	go userSvc.SyncRevocations(context.Background(), config.GetRevocationSyncInterval())
+	// Drop refresh tokens of ended sessions
+	go userSvc.PruneSessions(context.Background(), time.Hour)
+
 	// Set up WebSocket hub and handler
 	hub := ws.NewHub()
 	err = ws.LoadChatsIntoHub(hub, dbConn.GetDB())
 	if err != nil {
 		log.Fatalf("Failed to load chats into Hub: %v", err)
 	}
+	hub.EnableLinkPreviews(linkpreview.New())
 	go hub.Run(dbConn.GetDB())
 
-	wsHandler := ws.NewHandler(hub, dbConn.GetDB())
+	wsHandler := ws.NewHandler(hub, dbConn.GetDB(), store, userRep, tokens)
+	// Drop uploads that were never attached to a message
+	go wsHandler.PruneUnsentAttachments(context.Background(), time.Hour)
 
 	// Initialize and start the router
-	router.InitRouter(userHandler, wsHandler)
+	router.InitRouter(userHandler, wsHandler, tokens)
 
 	// Start the server
 	log.Printf("Server is running on port %s", port)
@@ -1,6 +1,12 @@
 package config
 
-import "os"
+import (
+    "log"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
 
 // GetSecretKey retrieves the JWT secret key for access tokens from an environment variable or defaults to "access_secret" for development
 func GetSecretKey() string {
@@ -11,11 +17,245 @@ func GetSecretKey() string {
     return key
 }
 
-// GetRefreshSecretKey retrieves the JWT secret key for refresh tokens from an environment variable or defaults to "refresh_secret" for development
-func GetRefreshSecretKey() string {
-    key := os.Getenv("JWT_REFRESH_SECRET")
-    if key == "" {
-        key = "refresh_secret" // Default value for development
+// GetSecretKeyID retrieves the key ID sent in the kid header of tokens signed with JWT_ACCESS_SECRET, or with JWT_PRIVATE_KEY_FILE when set, from an environment variable or defaults to "default".
+// Give every new key a new ID when rotating keys
+func GetSecretKeyID() string {
+    id := os.Getenv("JWT_ACCESS_KEY_ID")
+    if id == "" {
+        id = "default"
     }
-    return key
+    return id
+}
+
+// GetPreviousSecretKeys retrieves retired JWT secrets, as comma-separated id=secret pairs, from an environment variable.
+// Tokens signed with them are still accepted until they expire, so keep a retired secret for at least the access token lifetime
+func GetPreviousSecretKeys() map[string]string {
+    keys := make(map[string]string)
+    for _, pair := range strings.Split(os.Getenv("JWT_PREVIOUS_ACCESS_SECRETS"), ",") {
+        pair = strings.TrimSpace(pair)
+        if pair == "" {
+            continue
+        }
+        id, secret, ok := strings.Cut(pair, "=")
+        if !ok || id == "" || secret == "" {
+            log.Printf("Invalid entry in JWT_PREVIOUS_ACCESS_SECRETS, expected id=secret")
+            continue
+        }
+        keys[id] = secret
+    }
+    return keys
+}
+
+// GetPrivateKeyFile retrieves the path of a PEM-encoded RSA or Ed25519 private key from an environment variable.
+// When set, access tokens are signed with it (RS256 or EdDSA) instead of JWT_ACCESS_SECRET, and its public key is published at /.well-known/jwks.json
+func GetPrivateKeyFile() string {
+    return os.Getenv("JWT_PRIVATE_KEY_FILE")
+}
+
+// GetPreviousPublicKeyFiles retrieves the PEM files of retired public keys, as comma-separated id=path pairs, from an environment variable.
+// Tokens signed with their private keys are still accepted and the keys stay published until they are removed
+func GetPreviousPublicKeyFiles() map[string]string {
+    files := make(map[string]string)
+    for _, pair := range strings.Split(os.Getenv("JWT_PREVIOUS_PUBLIC_KEY_FILES"), ",") {
+        pair = strings.TrimSpace(pair)
+        if pair == "" {
+            continue
+        }
+        id, path, ok := strings.Cut(pair, "=")
+        if !ok || id == "" || path == "" {
+            log.Printf("Invalid entry in JWT_PREVIOUS_PUBLIC_KEY_FILES, expected id=path")
+            continue
+        }
+        files[id] = path
+    }
+    return files
+}
+
+// GetAccessTokenTTL retrieves how long access tokens are valid for from an environment variable or defaults to 15 minutes
+func GetAccessTokenTTL() time.Duration {
+    const defaultTTL = 15 * time.Minute
+    value := os.Getenv("JWT_ACCESS_TOKEN_TTL")
+    if value == "" {
+        return defaultTTL
+    }
+    ttl, err := time.ParseDuration(value)
+    if err != nil || ttl <= 0 {
+        log.Printf("Invalid JWT_ACCESS_TOKEN_TTL %q, using %s", value, defaultTTL)
+        return defaultTTL
+    }
+    return ttl
+}
+
+// GetRefreshTokenTTL retrieves how long a session lasts without being refreshed from an environment variable or defaults to 7 days
+func GetRefreshTokenTTL() time.Duration {
+    const defaultTTL = 7 * 24 * time.Hour
+    value := os.Getenv("JWT_REFRESH_TOKEN_TTL")
+    if value == "" {
+        return defaultTTL
+    }
+    ttl, err := time.ParseDuration(value)
+    if err != nil || ttl <= 0 {
+        log.Printf("Invalid JWT_REFRESH_TOKEN_TTL %q, using %s", value, defaultTTL)
+        return defaultTTL
+    }
+    return ttl
+}
+
+// GetRevocationSyncInterval retrieves how often revoked access tokens are reloaded from the database from an environment variable or defaults to 10 seconds
+// Tokens revoked through another server instance are accepted here for at most this long
+func GetRevocationSyncInterval() time.Duration {
+    const defaultInterval = 10 * time.Second
+    value := os.Getenv("REVOCATION_SYNC_INTERVAL")
+    if value == "" {
+        return defaultInterval
+    }
+    interval, err := time.ParseDuration(value)
+    if err != nil || interval <= 0 {
+        log.Printf("Invalid REVOCATION_SYNC_INTERVAL %q, using %s", value, defaultInterval)
+        return defaultInterval
+    }
+    return interval
+}
+
+// GetTokenIssuer retrieves the iss claim of access tokens from an environment variable or defaults to "komunikator"
+func GetTokenIssuer() string {
+    issuer := os.Getenv("JWT_ISSUER")
+    if issuer == "" {
+        issuer = "komunikator"
+    }
+    return issuer
+}
+
+// GetTokenAudience retrieves the aud claim of access tokens, which verified tokens must carry, from an environment variable or defaults to "komunikator-api"
+func GetTokenAudience() string {
+    audience := os.Getenv("JWT_AUDIENCE")
+    if audience == "" {
+        audience = "komunikator-api"
+    }
+    return audience
+}
+
+// GetMessageEditWindow retrieves how long after sending a message may be edited from an environment variable.
+// Zero (the default) means messages can be edited at any time
+func GetMessageEditWindow() time.Duration {
+    value := os.Getenv("MESSAGE_EDIT_WINDOW")
+    if value == "" {
+        return 0
+    }
+    window, err := time.ParseDuration(value)
+    if err != nil || window < 0 {
+        log.Printf("Invalid MESSAGE_EDIT_WINDOW %q, allowing edits at any time", value)
+        return 0
+    }
+    return window
+}
+
+// GetStorageBackend retrieves where uploaded files are stored from an environment variable: "local" (the default) or "s3"
+func GetStorageBackend() string {
+    backend := os.Getenv("STORAGE_BACKEND")
+    if backend == "" {
+        backend = "local"
+    }
+    return backend
+}
+
+// GetStorageDir retrieves the directory for the local storage backend from an environment variable or defaults to "uploads"
+func GetStorageDir() string {
+    dir := os.Getenv("STORAGE_DIR")
+    if dir == "" {
+        dir = "uploads"
+    }
+    return dir
+}
+
+// S3Settings configures the S3-compatible storage backend
+type S3Settings struct {
+    Endpoint        string // Base URL, e.g. https://s3.eu-central-1.amazonaws.com or http://localhost:9000
+    Region          string
+    Bucket          string
+    AccessKeyID     string
+    SecretAccessKey string
+}
+
+// GetS3Settings retrieves the S3-compatible storage settings from environment variables. The region defaults to "us-east-1"
+func GetS3Settings() S3Settings {
+    settings := S3Settings{
+        Endpoint:        os.Getenv("S3_ENDPOINT"),
+        Region:          os.Getenv("S3_REGION"),
+        Bucket:          os.Getenv("S3_BUCKET"),
+        AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+        SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+    }
+    if settings.Region == "" {
+        settings.Region = "us-east-1"
+    }
+    return settings
+}
+
+// GetMaxUploadSize retrieves the maximum size of an uploaded file in bytes from an environment variable or defaults to 10 MiB
+func GetMaxUploadSize() int64 {
+    const defaultSize = 10 << 20
+    value := os.Getenv("MAX_UPLOAD_SIZE")
+    if value == "" {
+        return defaultSize
+    }
+    size, err := strconv.ParseInt(value, 10, 64)
+    if err != nil || size <= 0 {
+        log.Printf("Invalid MAX_UPLOAD_SIZE %q, using %d bytes", value, defaultSize)
+        return defaultSize
+    }
+    return size
+}
+
+// GetUnsentAttachmentTTL retrieves how long an upload may wait to be attached to a message from an environment variable or defaults to 24 hours
+// Older uploads are deleted together with their files
+func GetUnsentAttachmentTTL() time.Duration {
+    const defaultTTL = 24 * time.Hour
+    value := os.Getenv("UNSENT_ATTACHMENT_TTL")
+    if value == "" {
+        return defaultTTL
+    }
+    ttl, err := time.ParseDuration(value)
+    if err != nil || ttl <= 0 {
+        log.Printf("Invalid UNSENT_ATTACHMENT_TTL %q, using %s", value, defaultTTL)
+        return defaultTTL
+    }
+    return ttl
+}
+
+// GetLinkPreviewTimeout retrieves how long fetching a link preview may take from an environment variable or defaults to 5 seconds
+func GetLinkPreviewTimeout() time.Duration {
+    const defaultTimeout = 5 * time.Second
+    value := os.Getenv("LINK_PREVIEW_TIMEOUT")
+    if value == "" {
+        return defaultTimeout
+    }
+    timeout, err := time.ParseDuration(value)
+    if err != nil || timeout <= 0 {
+        log.Printf("Invalid LINK_PREVIEW_TIMEOUT %q, using %s", value, defaultTimeout)
+        return defaultTimeout
+    }
+    return timeout
+}
+
+// GetLinkPreviewMaxSize retrieves how many bytes of a page are read for its link preview from an environment variable or defaults to 512 KiB
+func GetLinkPreviewMaxSize() int64 {
+    const defaultSize = 512 << 10
+    value := os.Getenv("LINK_PREVIEW_MAX_SIZE")
+    if value == "" {
+        return defaultSize
+    }
+    size, err := strconv.ParseInt(value, 10, 64)
+    if err != nil || size <= 0 {
+        log.Printf("Invalid LINK_PREVIEW_MAX_SIZE %q, using %d bytes", value, defaultSize)
+        return defaultSize
+    }
+    return size
+}
+
+// GetLinkPreviewAllowPrivateNetworks retrieves whether link previews may be fetched from private and loopback addresses from an environment variable.
+// Only meant for development against a local server; defaults to false
+func GetLinkPreviewAllowPrivateNetworks() bool {
+    allow, _ := strconv.ParseBool(os.Getenv("LINK_PREVIEW_ALLOW_PRIVATE_NETWORKS"))
+    return allow
 }
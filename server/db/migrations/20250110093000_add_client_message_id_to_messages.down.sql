@@ -0,0 +1,3 @@
+-- Drop the client-generated idempotency key from `messages`
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_sender_client_message_id_key;
+ALTER TABLE messages DROP COLUMN IF EXISTS client_message_id;
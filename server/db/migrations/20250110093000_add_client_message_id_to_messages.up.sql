@@ -0,0 +1,6 @@
+-- Add the client-generated idempotency key to `messages`
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS client_message_id VARCHAR(64); -- Client-generated message ID
+
+-- Deduplicate retried sends from the same user
+ALTER TABLE messages
+    ADD CONSTRAINT messages_sender_client_message_id_key UNIQUE (sender_id, client_message_id);
@@ -0,0 +1,4 @@
+-- Drop the per-chat sequence number
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_chat_id_seq_key;
+ALTER TABLE messages DROP COLUMN IF EXISTS seq;
+ALTER TABLE chats DROP COLUMN IF EXISTS last_seq;
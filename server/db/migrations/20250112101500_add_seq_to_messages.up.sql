@@ -0,0 +1,20 @@
+-- Track the last assigned message sequence number per chat
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS last_seq BIGINT NOT NULL DEFAULT 0; -- Last message sequence number
+
+-- Add the per-chat sequence number to `messages`
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS seq BIGINT; -- Per-chat message sequence number
+
+-- Number existing messages in the order they were sent
+UPDATE messages m
+SET seq = numbered.seq
+FROM (
+    SELECT id, ROW_NUMBER() OVER (PARTITION BY chat_id ORDER BY created_at, id) AS seq
+    FROM messages
+) numbered
+WHERE m.id = numbered.id;
+
+UPDATE chats c
+SET last_seq = COALESCE((SELECT MAX(seq) FROM messages WHERE chat_id = c.id), 0);
+
+ALTER TABLE messages ALTER COLUMN seq SET NOT NULL;
+ALTER TABLE messages ADD CONSTRAINT messages_chat_id_seq_key UNIQUE (chat_id, seq);
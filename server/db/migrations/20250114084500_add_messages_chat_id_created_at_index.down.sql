@@ -0,0 +1,2 @@
+-- Drop the chat history index
+DROP INDEX IF EXISTS idx_messages_chat_id_created_at;
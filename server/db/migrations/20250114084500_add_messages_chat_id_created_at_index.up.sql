@@ -0,0 +1,2 @@
+-- Speed up paging through a chat's history and searching it by date
+CREATE INDEX IF NOT EXISTS idx_messages_chat_id_created_at ON messages (chat_id, created_at);
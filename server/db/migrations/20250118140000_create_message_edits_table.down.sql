@@ -0,0 +1,3 @@
+-- Drop the `message_edits` table
+DROP TABLE IF EXISTS message_edits;
+ALTER TABLE messages DROP COLUMN IF EXISTS edited_at;
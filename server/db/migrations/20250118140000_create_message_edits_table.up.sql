@@ -0,0 +1,12 @@
+-- Track when a message was last edited
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS edited_at TIMESTAMP; -- Timestamp of the last edit
+
+-- Create the `message_edits` table
+CREATE TABLE IF NOT EXISTS message_edits (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),             -- Edit ID
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE, -- Edited message
+    content TEXT NOT NULL,                                     -- Content before the edit
+    edited_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP              -- Timestamp of the edit
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_edits_message_id ON message_edits (message_id, edited_at);
@@ -0,0 +1,10 @@
+-- Mark messages deleted for everyone
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP; -- Timestamp of deletion for everyone
+
+-- Create the `hidden_messages` table for messages deleted for a single user
+CREATE TABLE IF NOT EXISTS hidden_messages (
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE, -- Hidden message
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,       -- User who hid the message
+    hidden_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,             -- Timestamp of the deletion
+    PRIMARY KEY (user_id, message_id)                          -- Composite primary key
+);
@@ -0,0 +1,3 @@
+-- Drop the replied-to message from `messages`
+DROP INDEX IF EXISTS idx_messages_reply_to_id;
+ALTER TABLE messages DROP COLUMN IF EXISTS reply_to_id;
@@ -0,0 +1,6 @@
+-- Add the replied-to message to `messages`
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS reply_to_id UUID REFERENCES messages(id) ON DELETE SET NULL; -- Message being replied to
+
+-- Speed up loading threads and counting replies
+CREATE INDEX IF NOT EXISTS idx_messages_reply_to_id ON messages (reply_to_id);
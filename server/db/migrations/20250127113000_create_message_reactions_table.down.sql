@@ -0,0 +1,2 @@
+-- Drop the `message_reactions` table
+DROP TABLE IF EXISTS message_reactions;
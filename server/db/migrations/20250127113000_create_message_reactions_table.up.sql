@@ -0,0 +1,8 @@
+-- Create the `message_reactions` table
+CREATE TABLE IF NOT EXISTS message_reactions (
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE, -- Message reacted to
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,       -- User who reacted
+    emoji VARCHAR(32) NOT NULL,                                -- Reaction emoji
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,            -- Timestamp of the reaction
+    PRIMARY KEY (message_id, user_id, emoji)                   -- Composite primary key
+);
@@ -0,0 +1,5 @@
+-- Drop the read cursor from `chat_members`
+ALTER TABLE chat_members
+    DROP COLUMN IF EXISTS last_read_message,
+    DROP COLUMN IF EXISTS last_read_seq,
+    DROP COLUMN IF EXISTS last_read_at;
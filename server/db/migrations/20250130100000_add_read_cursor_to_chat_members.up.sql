@@ -0,0 +1,5 @@
+-- Track how far each member has read
+ALTER TABLE chat_members
+    ADD COLUMN IF NOT EXISTS last_read_message UUID REFERENCES messages(id) ON DELETE SET NULL, -- Last message read
+    ADD COLUMN IF NOT EXISTS last_read_seq BIGINT NOT NULL DEFAULT 0,                         -- Sequence number of that message
+    ADD COLUMN IF NOT EXISTS last_read_at TIMESTAMP;                                          -- Timestamp of the last read
@@ -0,0 +1,2 @@
+-- Drop the user chat list index
+DROP INDEX IF EXISTS idx_chat_members_user_id;
@@ -0,0 +1,2 @@
+-- Speed up listing a user's chats
+CREATE INDEX IF NOT EXISTS idx_chat_members_user_id ON chat_members (user_id);
@@ -0,0 +1,2 @@
+-- Drop the last seen timestamp from `users`
+ALTER TABLE users DROP COLUMN IF EXISTS last_seen_at;
@@ -0,0 +1,2 @@
+-- Track when each user was last seen online
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMP; -- Timestamp of the last presence change
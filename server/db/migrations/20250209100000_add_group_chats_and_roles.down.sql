@@ -0,0 +1,5 @@
+-- Drop group chat metadata and member roles
+ALTER TABLE chat_members DROP COLUMN IF EXISTS role;
+ALTER TABLE chats
+    DROP COLUMN IF EXISTS is_group,
+    DROP COLUMN IF EXISTS avatar_url;
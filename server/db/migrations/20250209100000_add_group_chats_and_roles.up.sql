@@ -0,0 +1,20 @@
+-- Distinguish named group chats and store their avatar
+ALTER TABLE chats
+    ADD COLUMN IF NOT EXISTS is_group BOOLEAN NOT NULL DEFAULT false, -- Group chat with managed membership
+    ADD COLUMN IF NOT EXISTS avatar_url TEXT;                         -- Group avatar
+
+-- Existing chats with more than two members are groups
+UPDATE chats c
+SET is_group = true
+WHERE (SELECT COUNT(*) FROM chat_members cm WHERE cm.chat_id = c.id) > 2;
+
+-- Add member roles to `chat_members`
+ALTER TABLE chat_members
+    ADD COLUMN IF NOT EXISTS role VARCHAR(16) NOT NULL DEFAULT 'member'
+        CHECK (role IN ('owner', 'admin', 'member')); -- Member role
+
+-- The creator of a chat owns it
+UPDATE chat_members cm
+SET role = 'owner'
+FROM chats c
+WHERE c.id = cm.chat_id AND c.creator_id = cm.user_id;
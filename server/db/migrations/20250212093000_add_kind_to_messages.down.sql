@@ -0,0 +1,4 @@
+-- Drop system message columns
+ALTER TABLE messages
+    DROP COLUMN IF EXISTS kind,
+    DROP COLUMN IF EXISTS event;
@@ -0,0 +1,5 @@
+-- Distinguish server-generated system messages from user messages
+ALTER TABLE messages
+    ADD COLUMN IF NOT EXISTS kind VARCHAR(16) NOT NULL DEFAULT 'user'
+        CHECK (kind IN ('user', 'system')), -- Message kind
+    ADD COLUMN IF NOT EXISTS event JSONB;   -- Structured event of a system message
@@ -0,0 +1,2 @@
+-- Drop the `attachments` table
+DROP TABLE IF EXISTS attachments;
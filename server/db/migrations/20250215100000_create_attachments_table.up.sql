@@ -0,0 +1,14 @@
+-- Create the `attachments` table for files uploaded to chats
+CREATE TABLE IF NOT EXISTS attachments (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),                -- Attachment ID
+    chat_id UUID NOT NULL REFERENCES chats(id) ON DELETE CASCADE, -- Chat the file was uploaded to
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE,    -- Message the file is attached to, once sent
+    uploader_id UUID NOT NULL REFERENCES users(id),               -- User who uploaded the file
+    storage_key TEXT NOT NULL,                                    -- Key of the file in the storage backend
+    filename VARCHAR(255) NOT NULL,                               -- Original file name
+    content_type VARCHAR(255) NOT NULL,                           -- Sniffed MIME type
+    size BIGINT NOT NULL,                                         -- File size in bytes
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP                -- Upload timestamp
+);
+
+CREATE INDEX IF NOT EXISTS idx_attachments_message_id ON attachments (message_id);
@@ -0,0 +1,2 @@
+-- Drop the avatar reference from `users`
+ALTER TABLE users DROP COLUMN IF EXISTS avatar_id;
@@ -0,0 +1,2 @@
+-- Store the current avatar of each user
+ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_id UUID; -- Avatar whose variants are stored under avatars/<avatar_id>/
@@ -0,0 +1,3 @@
+-- Drop the full-text search index of `messages`
+DROP INDEX IF EXISTS idx_messages_search_vector;
+ALTER TABLE messages DROP COLUMN IF EXISTS search_vector;
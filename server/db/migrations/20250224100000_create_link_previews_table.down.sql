@@ -0,0 +1,3 @@
+-- Drop the link preview cache
+ALTER TABLE messages DROP COLUMN IF EXISTS link_urls;
+DROP TABLE IF EXISTS link_previews;
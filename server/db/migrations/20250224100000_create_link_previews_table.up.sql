@@ -0,0 +1,13 @@
+-- Create the `link_previews` table caching the metadata of linked pages
+CREATE TABLE IF NOT EXISTS link_previews (
+    url TEXT PRIMARY KEY,                                   -- Linked URL as written in messages
+    title TEXT NOT NULL DEFAULT '',                         -- Page title
+    description TEXT NOT NULL DEFAULT '',                   -- Page description
+    image_url TEXT NOT NULL DEFAULT '',                     -- Absolute URL of the preview image
+    site_name TEXT NOT NULL DEFAULT '',                     -- Name of the website
+    failed BOOLEAN NOT NULL DEFAULT FALSE,                  -- The page could not be previewed
+    fetched_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP -- When the page was last fetched
+);
+
+-- Remember which links each message contains
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS link_urls TEXT[] NOT NULL DEFAULT '{}'; -- Previewed URLs in order of appearance
@@ -0,0 +1,2 @@
+-- Drop the `message_mentions` table
+DROP TABLE IF EXISTS message_mentions;
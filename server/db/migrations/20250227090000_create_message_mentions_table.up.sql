@@ -0,0 +1,10 @@
+-- Create the `message_mentions` table for @username mentions
+CREATE TABLE IF NOT EXISTS message_mentions (
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE, -- Message containing the mention
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,       -- Mentioned member of the chat
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,            -- When the message was sent
+    PRIMARY KEY (message_id, user_id)
+);
+
+-- Speed up listing the mentions of a user
+CREATE INDEX IF NOT EXISTS idx_message_mentions_user_id ON message_mentions (user_id);
@@ -0,0 +1,2 @@
+-- Drop the `sessions` table
+DROP TABLE IF EXISTS sessions;
@@ -0,0 +1,17 @@
+-- Create the `sessions` table holding one row per issued refresh token
+CREATE TABLE IF NOT EXISTS sessions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),                 -- Refresh token ID
+    family_id UUID NOT NULL,                                       -- Sign-in the token was rotated from; the session ID users see
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,  -- Signed-in user
+    token_hash CHAR(64) NOT NULL UNIQUE,                           -- Hex SHA-256 of the refresh token
+    user_agent VARCHAR(255) NOT NULL DEFAULT '',                   -- Client that used the token
+    ip_address VARCHAR(45) NOT NULL DEFAULT '',                    -- Address the token was used from
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,       -- When the token was issued
+    expires_at TIMESTAMP NOT NULL,                                 -- When the token stops working
+    rotated_at TIMESTAMP,                                          -- When the token was exchanged for a new one
+    revoked_at TIMESTAMP                                           -- When the session was signed out
+);
+
+-- Speed up listing a user's sessions and revoking a session
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
+CREATE INDEX IF NOT EXISTS idx_sessions_family_id ON sessions (family_id);
@@ -0,0 +1,2 @@
+-- Drop the `token_revocations` table
+DROP TABLE IF EXISTS token_revocations;
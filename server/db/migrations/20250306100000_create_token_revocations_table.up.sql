@@ -0,0 +1,7 @@
+-- Create the `token_revocations` table for access tokens revoked before they expire
+CREATE TABLE IF NOT EXISTS token_revocations (
+    kind VARCHAR(16) NOT NULL CHECK (kind IN ('token', 'session')), -- Whether subject is a token ID or a session ID
+    subject UUID NOT NULL,                                          -- jti of the token, or family_id of the session
+    expires_at TIMESTAMP NOT NULL,                                  -- When every affected access token has expired
+    PRIMARY KEY (kind, subject)
+);
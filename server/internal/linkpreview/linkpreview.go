@@ -0,0 +1,316 @@
+package linkpreview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"server/config"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	maxRedirects      = 5
+	maxURLLength      = 2048
+	maxTitleLength    = 300
+	maxDescLength     = 500
+	maxSiteNameLength = 100
+)
+
+var (
+	// ErrBlockedAddress is returned when a URL resolves to an address the
+	// server must not connect to, such as a private or loopback address.
+	ErrBlockedAddress = errors.New("address is not publicly routable")
+	// ErrNoMetadata is returned when a page has neither a title nor a description.
+	ErrNoMetadata = errors.New("page has no preview metadata")
+)
+
+// Preview is the metadata shown for a link.
+type Preview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	ImageURL    string `json:"imageURL,omitempty"`
+	SiteName    string `json:"siteName,omitempty"`
+}
+
+// Options configures a Fetcher.
+type Options struct {
+	Timeout     time.Duration // Limit for the whole fetch, including redirects
+	MaxBodySize int64         // Bytes of the page read at most
+	// AllowPrivateNetworks disables the address checks, so pages served by a
+	// local stand-in can be fetched. Never enable it in production.
+	AllowPrivateNetworks bool
+}
+
+// Fetcher downloads pages and extracts their OpenGraph or HTML metadata.
+type Fetcher struct {
+	client      *http.Client
+	maxBodySize int64
+}
+
+// New creates a Fetcher configured from the environment.
+func New() *Fetcher {
+	return NewFetcher(Options{
+		Timeout:              config.GetLinkPreviewTimeout(),
+		MaxBodySize:          config.GetLinkPreviewMaxSize(),
+		AllowPrivateNetworks: config.GetLinkPreviewAllowPrivateNetworks(),
+	})
+}
+
+// NewFetcher creates a Fetcher with the given options.
+func NewFetcher(opts Options) *Fetcher {
+	dialer := &net.Dialer{Timeout: opts.Timeout}
+	if !opts.AllowPrivateNetworks {
+		// The check runs on the resolved address of every connection, so
+		// redirects and DNS answers cannot point the fetcher inside the network
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return fmt.Errorf("%w: %s", ErrBlockedAddress, host)
+			}
+			return nil
+		}
+	}
+
+	transport := &http.Transport{
+		Proxy:                 nil, // A proxy would bypass the address checks
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   opts.Timeout,
+		ResponseHeaderTimeout: opts.Timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+
+	return &Fetcher{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   opts.Timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > maxRedirects {
+					return errors.New("too many redirects")
+				}
+				if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+					return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+				}
+				return nil
+			},
+		},
+		maxBodySize: opts.MaxBodySize,
+	}
+}
+
+// blockedNetworks lists special-purpose ranges not covered by the net.IP
+// predicates used in isPublicIP.
+var blockedNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",     // "This" network
+		"100.64.0.0/10", // Carrier-grade NAT
+		"192.0.0.0/24",  // IETF protocol assignments
+		"198.18.0.0/15", // Benchmarking
+		"240.0.0.0/4",   // Reserved
+		"64:ff9b::/96",  // NAT64, which can reach private IPv4 addresses
+		"2001:db8::/32", // Documentation
+	} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// isPublicIP reports whether ip is a globally routable unicast address.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// urlPattern matches http and https URLs in message text.
+var urlPattern = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"]+`)
+
+// ExtractURLs returns up to limit distinct http and https URLs found in text,
+// in order of appearance. Punctuation trailing a URL is not part of it.
+func ExtractURLs(text string, limit int) []string {
+	var urls []string
+	seen := make(map[string]bool)
+	for _, match := range urlPattern.FindAllString(text, -1) {
+		if len(urls) == limit {
+			break
+		}
+		match = strings.TrimRight(match, ".,;:!?'")
+		// Keep closing parentheses that belong to the URL, as in Wikipedia links
+		for strings.HasSuffix(match, ")") && strings.Count(match, ")") > strings.Count(match, "(") {
+			match = strings.TrimSuffix(match, ")")
+		}
+		if len(match) > maxURLLength {
+			continue
+		}
+		parsed, err := url.Parse(match)
+		if err != nil || parsed.Hostname() == "" || parsed.User != nil {
+			continue
+		}
+		normalized := parsed.String()
+		if !seen[normalized] {
+			seen[normalized] = true
+			urls = append(urls, normalized)
+		}
+	}
+	return urls
+}
+
+// Fetch downloads the page at rawURL and returns its preview.
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (*Preview, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", req.URL.Scheme)
+	}
+	req.Header.Set("User-Agent", "KomunikatorBot/1.0 (link preview)")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, fmt.Errorf("unsupported content type %q", mediaType)
+	}
+
+	preview := parseMetadata(io.LimitReader(resp.Body, f.maxBodySize), resp.Request.URL)
+	if preview.Title == "" && preview.Description == "" {
+		return nil, ErrNoMetadata
+	}
+	preview.URL = rawURL
+	return preview, nil
+}
+
+// parseMetadata reads the head of an HTML page. OpenGraph properties take
+// precedence over the title element and the description meta tag.
+func parseMetadata(body io.Reader, pageURL *url.URL) *Preview {
+	var title, description, ogTitle, ogDescription, ogImage, ogSiteName string
+	tokenizer := html.NewTokenizer(body)
+	inTitle := false
+
+parse:
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			// End of the page or of the bytes allowed to be read
+			break parse
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "title":
+				inTitle = title == ""
+			case "meta":
+				var key, content string
+				for _, attr := range token.Attr {
+					switch attr.Key {
+					case "property", "name":
+						key = strings.ToLower(attr.Val)
+					case "content":
+						content = attr.Val
+					}
+				}
+				switch key {
+				case "og:title":
+					ogTitle = content
+				case "og:description":
+					ogDescription = content
+				case "og:image", "og:image:url":
+					if ogImage == "" {
+						ogImage = content
+					}
+				case "og:site_name":
+					ogSiteName = content
+				case "description":
+					description = content
+				}
+			case "body":
+				break parse
+			}
+		case html.TextToken:
+			if inTitle {
+				title += string(tokenizer.Text())
+			}
+		case html.EndTagToken:
+			if name, _ := tokenizer.TagName(); string(name) == "title" {
+				inTitle = false
+			} else if string(name) == "head" {
+				break parse
+			}
+		}
+	}
+
+	return &Preview{
+		Title:       clean(firstNonEmpty(ogTitle, title), maxTitleLength),
+		Description: clean(firstNonEmpty(ogDescription, description), maxDescLength),
+		ImageURL:    resolveImageURL(pageURL, ogImage),
+		SiteName:    clean(ogSiteName, maxSiteNameLength),
+	}
+}
+
+// resolveImageURL makes an image reference absolute. Only http and https
+// images are kept.
+func resolveImageURL(pageURL *url.URL, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || len(ref) > maxURLLength {
+		return ""
+	}
+	parsed, err := pageURL.Parse(ref)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return ""
+	}
+	return parsed.String()
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if strings.TrimSpace(value) != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// clean collapses whitespace, drops invalid UTF-8 and shortens the text to
+// limit characters.
+func clean(text string, limit int) string {
+	text = strings.Join(strings.Fields(strings.ToValidUTF8(text, "")), " ")
+	if utf8.RuneCountInString(text) > limit {
+		text = strings.TrimSpace(string([]rune(text)[:limit-1])) + "…"
+	}
+	return text
+}
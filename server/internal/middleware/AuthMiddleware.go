@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"server/util"
@@ -9,7 +10,8 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func AuthMiddleware() gin.HandlerFunc {
+// AuthMiddleware rejects requests without a valid access token from tokens.
+func AuthMiddleware(tokens *util.TokenIssuer) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var token string
 
@@ -33,13 +35,15 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		// Validate the token (assumes it's an access token, hence `false`)
-		claims, err := util.ValidateToken(token, false)
+		// Validate the access token
+		claims, err := tokens.ValidateToken(token)
 		if err != nil {
 			log.Printf("Token validation error: %v", err)
 
 			// Handle specific error cases
-			if strings.Contains(err.Error(), "expired") {
+			if errors.Is(err, util.ErrTokenRevoked) {
+				sendUnauthorizedResponse(c, "Token revoked")
+			} else if strings.Contains(err.Error(), "expired") {
 				sendUnauthorizedResponse(c, "Token expired")
 			} else {
 				sendUnauthorizedResponse(c, "Invalid token")
@@ -53,6 +57,8 @@ func AuthMiddleware() gin.HandlerFunc {
 		// Store user information in the context for later use
 		c.Set("userID", claims.ID)
 		c.Set("username", claims.Username)
+		c.Set("sessionID", claims.SessionID)
+		c.Set("tokenID", claims.RegisteredClaims.ID)
 
 		// Proceed to the next handler
 		c.Next()
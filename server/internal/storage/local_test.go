@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalStorage(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewLocalStorage(filepath.Join(root, "uploads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	key := "avatars/user/64.png"
+	data := "png bytes"
+
+	if err := store.Put(ctx, key, strings.NewReader(data), int64(len(data)), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "uploads", "avatars", "user", "64.png")); err != nil {
+		t.Errorf("object file: %v", err)
+	}
+
+	body, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || string(got) != data {
+		t.Errorf("Get = %q, %v, want %q", got, err, data)
+	}
+
+	// A short body must not replace the stored object
+	if err := store.Put(ctx, key, strings.NewReader("png"), int64(len(data)), "image/png"); err == nil {
+		t.Error("Put accepted a body shorter than its size")
+	}
+	entries, _ := os.ReadDir(filepath.Join(root, "uploads", "avatars", "user"))
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d entries, want only the object", len(entries))
+	}
+
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete: err = %v, want %v", err, ErrNotFound)
+	}
+	if err := store.Delete(ctx, key); err != nil {
+		t.Errorf("Delete of a missing object: %v", err)
+	}
+	if err := store.Put(ctx, "../outside", strings.NewReader(data), int64(len(data)), ""); err == nil {
+		t.Error("Put accepted a key escaping the root")
+	}
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"server/config"
+	"strings"
+)
+
+// ErrNotFound is returned when no object is stored under a key.
+var ErrNotFound = errors.New("object not found")
+
+// Storage keeps uploaded files under slash-separated keys.
+type Storage interface {
+	// Put stores size bytes read from body under key, replacing any existing object.
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	// Get opens the object stored under key. The caller must close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the object stored under key. Missing objects are not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// New creates the storage backend selected by the configuration.
+func New() (Storage, error) {
+	switch backend := config.GetStorageBackend(); backend {
+	case "local":
+		return NewLocalStorage(config.GetStorageDir())
+	case "s3":
+		return NewS3Storage(config.GetS3Settings())
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+// validKey rejects keys that could escape the storage root.
+func validKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") {
+		return fmt.Errorf("invalid storage key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." || strings.Contains(part, "\\") {
+			return fmt.Errorf("invalid storage key %q", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package storage
+
+import "testing"
+
+func TestValidKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		valid bool
+	}{
+		{"avatars/user/64.png", true},
+		{"attachments/chat/file name.pdf", true},
+		{"..", false},
+		{"avatars/../secret", false},
+		{"./avatars", false},
+		{"/etc/passwd", false},
+		{"avatars\\..\\secret", false},
+		{"avatars//64.png", false},
+		{"avatars/", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if err := validKey(tt.key); (err == nil) != tt.valid {
+			t.Errorf("validKey(%q) = %v, want valid %v", tt.key, err, tt.valid)
+		}
+	}
+}
@@ -1,12 +1,17 @@
 package user
 
-import "context"
+import (
+	"context"
+	"io"
+	"time"
+)
 
 type User struct {
-	ID       string  `json:"id" db:"id"`
-	Username string `json:"username" db:"username"`
-	Email    string `json:"email" db:"email"`
-	Password string `json:"password" db:"password"`
+	ID        string `json:"id" db:"id"`
+	Username  string `json:"username" db:"username"`
+	Email     string `json:"email" db:"email"`
+	Password  string `json:"password" db:"password"`
+	AvatarURL string `json:"avatarURL,omitempty" db:"avatar_id"`
 }
 
 type CreateUserReq struct {
@@ -26,10 +31,61 @@ type LoginUserReq struct {
 	Password string `json:"password" db:"password"`
 }
 
+// LoginUserRes carries the token pair of the new session, under the same
+// names as the pair returned on refresh.
 type LoginUserRes struct {
-	accessToken string
-	ID          string `json:"id" db:"id"`
-	Username    string `json:"username" db:"username"`
+	TokenPair
+	ID       string `json:"id" db:"id"`
+	Username string `json:"username" db:"username"`
+}
+
+// TokenPair is issued when signing in and on every refresh. The refresh token
+// can be exchanged for a new pair exactly once.
+type TokenPair struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// ClientInfo describes the device a session is used from.
+type ClientInfo struct {
+	UserAgent string
+	IPAddress string
+}
+
+// Session is a signed-in device. Its ID stays the same while its refresh
+// token rotates.
+type Session struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"userAgent"`
+	IPAddress  string    `json:"ipAddress"`
+	CreatedAt  time.Time `json:"createdAt"`  // Sign-in time
+	LastUsedAt time.Time `json:"lastUsedAt"` // Last token refresh
+	ExpiresAt  time.Time `json:"expiresAt"`  // End of the session unless refreshed
+	Current    bool      `json:"current"`    // The session of the request
+}
+
+// SessionToken is the stored state of one refresh token.
+type SessionToken struct {
+	ID       string
+	FamilyID string // Session the token belongs to
+	UserID   string
+	Username string
+	Rotated  bool // Already exchanged for a new token
+	Revoked  bool
+	Expired  bool
+}
+
+// Kinds of access token revocations
+const (
+	revocationToken   = "token"   // One access token, by its jti
+	revocationSession = "session" // Every access token of a session
+)
+
+// Revocation is a stored revocation of access tokens that have not expired yet.
+type Revocation struct {
+	Kind      string // revocationToken or revocationSession
+	Subject   string // Token ID or session ID
+	ExpiresIn time.Duration
 }
 
 type Repository interface {
@@ -38,12 +94,36 @@ type Repository interface {
     UserExistsByEmail(ctx context.Context, email string) (bool, error)
     UserExistsByUsername(ctx context.Context, username string) (bool, error)
     SearchUsers(ctx context.Context, query string) ([]*User, error) 
+    SetAvatar(ctx context.Context, userID string, avatarID string) (previousID string, err error)
+    GetUsersByUsernames(ctx context.Context, usernames []string) ([]*User, error)
+    CreateSession(ctx context.Context, familyID string, userID string, tokenHash string, client ClientInfo, ttl time.Duration) error
+    GetSessionToken(ctx context.Context, tokenHash string) (*SessionToken, error)
+    RotateSessionToken(ctx context.Context, tokenID string, newTokenHash string, client ClientInfo, ttl time.Duration) (rotated bool, err error)
+    RevokeSessionFamily(ctx context.Context, familyID string) error
+    ListSessions(ctx context.Context, userID string) ([]*Session, error)
+    RevokeSession(ctx context.Context, userID string, sessionID string) (revoked bool, err error)
+    RevokeAllSessions(ctx context.Context, userID string) (sessionIDs []string, err error)
+    DeleteEndedSessions(ctx context.Context) (deleted int64, err error)
+    SaveRevocations(ctx context.Context, kind string, subjects []string, ttl time.Duration) error
+    GetRevocations(ctx context.Context) ([]*Revocation, error)
 }
 
 
 type Service interface {
     CreateUser(c context.Context, req *CreateUserReq) (*CreateUserRes, error)
-    Login(c context.Context, req *LoginUserReq) (*LoginUserRes, error)
+    Login(c context.Context, req *LoginUserReq, client ClientInfo) (*LoginUserRes, error)
     SearchUsers(ctx context.Context, query string) ([]*User, error)
+    UpdateAvatar(ctx context.Context, userID string, data []byte) (avatarURL string, err error)
+    DeleteAvatar(ctx context.Context, userID string) error
+    GetAvatar(ctx context.Context, avatarID string, size int) (io.ReadCloser, error)
+    StartSession(ctx context.Context, userID string, username string, client ClientInfo) (*TokenPair, error)
+    RefreshSession(ctx context.Context, refreshToken string, client ClientInfo) (*TokenPair, error)
+    ListSessions(ctx context.Context, userID string, currentSessionID string) ([]*Session, error)
+    RevokeSession(ctx context.Context, userID string, sessionID string) error
+    Logout(ctx context.Context, userID string, sessionID string, tokenID string) error
+    LogoutAllSessions(ctx context.Context, userID string) (int, error)
+    LoadRevocations(ctx context.Context) error
+    SyncRevocations(ctx context.Context, interval time.Duration)
+    PruneSessions(ctx context.Context, interval time.Duration)
 }
 
@@ -1,12 +1,19 @@
 package user
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"regexp"
+	"server/internal/storage"
 	"server/util"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 type Handler struct {
@@ -72,7 +79,7 @@ func (h *Handler) Login(c *gin.Context) {
 		return
 	}
 
-	u, err := h.Service.Login(c.Request.Context(), &user)
+	u, err := h.Service.Login(c.Request.Context(), &user, clientInfo(c))
 	if err != nil {
 		log.Printf("Error during login for email %s: %v", user.Email, err)
 		if err.Error() == "Invalid password" {
@@ -88,28 +95,48 @@ func (h *Handler) Login(c *gin.Context) {
 	}
 
 	log.Printf("Login successful: ID=%s, Username=%s", u.ID, u.Username)
+	c.JSON(http.StatusOK, u)
+}
 
-	// Generate the JWT token
-	token, err := util.GenerateAccessToken(u.ID, u.Username)
-	if err != nil {
-		log.Printf("Error generating token for user %s: %v", u.ID, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
-		return
+// clientInfo describes the device making the request, for listing sessions.
+func clientInfo(c *gin.Context) ClientInfo {
+	userAgent := c.Request.UserAgent()
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
 	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"token":    token,
-		"id":       u.ID,
-		"username": u.Username,
-	})
+	return ClientInfo{UserAgent: strings.ToValidUTF8(userAgent, ""), IPAddress: c.ClientIP()}
 }
 
+// Logout ends the session of the authenticated request. Its refresh token and
+// the access token used for the request stop working immediately.
 func (h *Handler) Logout(c *gin.Context) {
-	c.SetCookie("jwt", "", -1, "", "", false, true)
+	userID := c.GetString("userID")
+
+	if err := h.Service.Logout(c.Request.Context(), userID, c.GetString("sessionID"), c.GetString("tokenID")); err != nil {
+		log.Printf("Error logging out user %s: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
 	log.Printf("User logged out successfully")
 	c.JSON(http.StatusOK, gin.H{"message": "logout successful"})
 }
 
+// LogoutAll signs the authenticated user out on every device, including the
+// one making the request.
+func (h *Handler) LogoutAll(c *gin.Context) {
+	userID := c.GetString("userID")
+
+	count, err := h.Service.LogoutAllSessions(c.Request.Context(), userID)
+	if err != nil {
+		log.Printf("Error logging out all sessions of user %s: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "logout successful", "sessions": count})
+}
+
 func (h *Handler) SearchUsers(c *gin.Context) {
 	query := c.Query("q")
 	if query == "" {
@@ -129,6 +156,112 @@ func (h *Handler) SearchUsers(c *gin.Context) {
 	c.JSON(http.StatusOK, users)
 }
 
+// UploadAvatar replaces the authenticated user's avatar with the image
+// uploaded as the multipart field "avatar".
+func (h *Handler) UploadAvatar(c *gin.Context) {
+	userID := c.GetString("userID")
+
+	// Leave room for the multipart headers around the image
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxAvatarSize+64<<10)
+	file, header, err := c.Request.FormFile("avatar")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Avatar must be at most %d bytes", maxAvatarSize)})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "An avatar image is required"})
+		return
+	}
+	defer file.Close()
+
+	if header.Size > maxAvatarSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Avatar must be at most %d bytes", maxAvatarSize)})
+		return
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		log.Printf("Error reading avatar upload from user %s: %v", userID, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read image"})
+		return
+	}
+
+	avatarURL, err := h.Service.UpdateAvatar(c.Request.Context(), userID, data)
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidImage):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Avatar must be a PNG, JPEG or GIF image"})
+		case errors.Is(err, errImageTooLarge):
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Avatar must be at most %dx%d pixels", maxAvatarDimension, maxAvatarDimension)})
+		case errors.Is(err, errUserNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		default:
+			log.Printf("Error updating avatar of user %s: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update avatar"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"avatarURL": avatarURL})
+}
+
+// DeleteAvatar removes the authenticated user's avatar.
+func (h *Handler) DeleteAvatar(c *gin.Context) {
+	userID := c.GetString("userID")
+
+	if err := h.Service.DeleteAvatar(c.Request.Context(), userID); err != nil {
+		if errors.Is(err, errUserNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		log.Printf("Error deleting avatar of user %s: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete avatar"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Avatar deleted"})
+}
+
+// GetAvatar serves an avatar variant selected with ?size=. Avatar IDs change on
+// every upload, so responses can be cached indefinitely.
+func (h *Handler) GetAvatar(c *gin.Context) {
+	avatarID := c.Param("id")
+	if _, err := uuid.Parse(avatarID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Avatar not found"})
+		return
+	}
+
+	size, err := strconv.Atoi(c.DefaultQuery("size", strconv.Itoa(util.DefaultAvatarSize)))
+	if err != nil || !isAvatarSize(size) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("size must be one of %v", util.AvatarSizes)})
+		return
+	}
+
+	body, err := h.Service.GetAvatar(c.Request.Context(), avatarID, size)
+	if errors.Is(err, storage.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Avatar not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading avatar %s: %v", avatarID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read avatar"})
+		return
+	}
+	defer body.Close()
+
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	c.DataFromReader(http.StatusOK, -1, "image/png", body, nil)
+}
+
+func isAvatarSize(size int) bool {
+	for _, s := range util.AvatarSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *Handler) RefreshToken(c *gin.Context) {
 	refreshToken := c.GetHeader("Authorization")
 	if refreshToken == "" {
@@ -142,16 +275,53 @@ func (h *Handler) RefreshToken(c *gin.Context) {
 		refreshToken = refreshToken[7:]
 	}
 
-	log.Printf("Refreshing token for token: %s", refreshToken)
-
-	// Validate the refresh token and generate a new access token
-	newAccessToken, err := util.RefreshToken(refreshToken)
+	// Exchange the refresh token for a new pair; the old one stops working
+	tokens, err := h.Service.RefreshSession(c.Request.Context(), refreshToken, clientInfo(c))
 	if err != nil {
 		log.Printf("Error refreshing token: %v", err)
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+		switch {
+		case errors.Is(err, errInvalidRefreshToken):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+		case errors.Is(err, errRefreshRateLimited):
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded. Try again later"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token"})
+		}
 		return
 	}
 
 	log.Printf("Token refreshed successfully")
-	c.JSON(http.StatusOK, gin.H{"accessToken": newAccessToken})
+	c.JSON(http.StatusOK, tokens)
+}
+
+// ListSessions returns the devices the authenticated user is signed in on.
+func (h *Handler) ListSessions(c *gin.Context) {
+	userID := c.GetString("userID")
+
+	sessions, err := h.Service.ListSessions(c.Request.Context(), userID, c.GetString("sessionID"))
+	if err != nil {
+		log.Printf("Error listing sessions of user %s: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
+
+// RevokeSession signs the authenticated user out of one of their sessions.
+func (h *Handler) RevokeSession(c *gin.Context) {
+	userID := c.GetString("userID")
+	sessionID := c.Param("id")
+
+	if err := h.Service.RevokeSession(c.Request.Context(), userID, sessionID); err != nil {
+		if errors.Is(err, errSessionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+			return
+		}
+		log.Printf("Error revoking session %s of user %s: %v", sessionID, userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
 }
@@ -3,7 +3,12 @@ package user
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"server/util"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 type repository struct {
@@ -75,7 +80,7 @@ func (r *repository) SearchUsers(ctx context.Context, query string) ([]*User, er
 	var users []*User
 	searchQuery := "%" + query + "%"
 
-	rows, err := r.db.QueryContext(ctx, "SELECT id, username FROM users WHERE username ILIKE $1", searchQuery)
+	rows, err := r.db.QueryContext(ctx, "SELECT id, username, COALESCE(avatar_id::text, '') FROM users WHERE username ILIKE $1", searchQuery)
 	if err != nil {
 		return nil, fmt.Errorf("error querying users: %w", err)
 	}
@@ -83,9 +88,58 @@ func (r *repository) SearchUsers(ctx context.Context, query string) ([]*User, er
 
 	for rows.Next() {
 		var user User
-		if err := rows.Scan(&user.ID, &user.Username); err != nil {
+		var avatarID string
+		if err := rows.Scan(&user.ID, &user.Username, &avatarID); err != nil {
+			return nil, fmt.Errorf("error scanning user row: %w", err)
+		}
+		user.AvatarURL = util.AvatarURL(avatarID)
+		users = append(users, &user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over user rows: %w", err)
+	}
+
+	return users, nil
+}
+
+// SetAvatar replaces the user's avatar and returns the ID of the previous one.
+// An empty avatarID removes the avatar.
+func (r *repository) SetAvatar(ctx context.Context, userID string, avatarID string) (string, error) {
+	var previousID string
+	query := `
+		UPDATE users u SET avatar_id = NULLIF($2, '')::uuid
+		FROM users old
+		WHERE u.id = $1 AND old.id = u.id
+		RETURNING COALESCE(old.avatar_id::text, '')`
+	err := r.db.QueryRowContext(ctx, query, userID, avatarID).Scan(&previousID)
+	if err != nil {
+		return "", fmt.Errorf("error updating avatar: %w", err)
+	}
+	return previousID, nil
+}
+
+// GetUsersByUsernames returns the users with the given usernames. Unknown
+// usernames are skipped.
+func (r *repository) GetUsersByUsernames(ctx context.Context, usernames []string) ([]*User, error) {
+	users := []*User{}
+	if len(usernames) == 0 {
+		return users, nil
+	}
+
+	rows, err := r.db.QueryContext(ctx, "SELECT id, username, COALESCE(avatar_id::text, '') FROM users WHERE username = ANY($1)", pq.Array(usernames))
+	if err != nil {
+		return nil, fmt.Errorf("error querying users by username: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user User
+		var avatarID string
+		if err := rows.Scan(&user.ID, &user.Username, &avatarID); err != nil {
 			return nil, fmt.Errorf("error scanning user row: %w", err)
 		}
+		user.AvatarURL = util.AvatarURL(avatarID)
 		users = append(users, &user)
 	}
 
@@ -94,4 +148,226 @@ func (r *repository) SearchUsers(ctx context.Context, query string) ([]*User, er
 	}
 
 	return users, nil
-}
\ No newline at end of file
+}
+
+// CreateSession stores the first refresh token of a new session.
+func (r *repository) CreateSession(ctx context.Context, familyID string, userID string, tokenHash string, client ClientInfo, ttl time.Duration) error {
+	query := `
+		INSERT INTO sessions (family_id, user_id, token_hash, user_agent, ip_address, expires_at)
+		VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP + make_interval(secs => $6))`
+	_, err := r.db.ExecContext(ctx, query, familyID, userID, tokenHash, client.UserAgent, client.IPAddress, ttl.Seconds())
+	if err != nil {
+		return fmt.Errorf("error creating session: %w", err)
+	}
+	return nil
+}
+
+// GetSessionToken looks up a refresh token by its hash.
+func (r *repository) GetSessionToken(ctx context.Context, tokenHash string) (*SessionToken, error) {
+	var t SessionToken
+	query := `
+		SELECT s.id, s.family_id, s.user_id, u.username,
+			s.rotated_at IS NOT NULL, s.revoked_at IS NOT NULL, s.expires_at <= CURRENT_TIMESTAMP
+		FROM sessions s
+		INNER JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = $1`
+	err := r.db.QueryRowContext(ctx, query, tokenHash).
+		Scan(&t.ID, &t.FamilyID, &t.UserID, &t.Username, &t.Rotated, &t.Revoked, &t.Expired)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying session: %w", err)
+	}
+	return &t, nil
+}
+
+// RotateSessionToken marks a refresh token as used and stores its successor in
+// the same session. It reports false when the token was used or revoked
+// concurrently.
+func (r *repository) RotateSessionToken(ctx context.Context, tokenID string, newTokenHash string, client ClientInfo, ttl time.Duration) (bool, error) {
+	query := `
+		WITH old AS (
+			UPDATE sessions SET rotated_at = CURRENT_TIMESTAMP
+			WHERE id = $1 AND rotated_at IS NULL AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+			RETURNING family_id, user_id
+		)
+		INSERT INTO sessions (family_id, user_id, token_hash, user_agent, ip_address, expires_at)
+		SELECT family_id, user_id, $2, $3, $4, CURRENT_TIMESTAMP + make_interval(secs => $5)
+		FROM old`
+	result, err := r.db.ExecContext(ctx, query, tokenID, newTokenHash, client.UserAgent, client.IPAddress, ttl.Seconds())
+	if err != nil {
+		return false, fmt.Errorf("error rotating session token: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error rotating session token: %w", err)
+	}
+	return rows == 1, nil
+}
+
+// RevokeSessionFamily revokes every refresh token of a session.
+func (r *repository) RevokeSessionFamily(ctx context.Context, familyID string) error {
+	query := "UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE family_id = $1 AND revoked_at IS NULL"
+	if _, err := r.db.ExecContext(ctx, query, familyID); err != nil {
+		return fmt.Errorf("error revoking session: %w", err)
+	}
+	return nil
+}
+
+// ListSessions returns the active sessions of a user, most recently used first.
+func (r *repository) ListSessions(ctx context.Context, userID string) ([]*Session, error) {
+	sessions := []*Session{}
+	query := `
+		SELECT s.family_id, s.user_agent, s.ip_address,
+			(SELECT MIN(f.created_at) FROM sessions f WHERE f.family_id = s.family_id),
+			s.created_at, s.expires_at
+		FROM sessions s
+		WHERE s.user_id = $1 AND s.rotated_at IS NULL AND s.revoked_at IS NULL AND s.expires_at > CURRENT_TIMESTAMP
+		ORDER BY s.created_at DESC`
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying sessions: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("error scanning session row: %w", err)
+		}
+		sessions = append(sessions, &s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over session rows: %w", err)
+	}
+
+	return sessions, nil
+}
+
+// RevokeSession signs a user out of one of their sessions. It reports false
+// when the user has no active session with that ID.
+func (r *repository) RevokeSession(ctx context.Context, userID string, sessionID string) (bool, error) {
+	query := `
+		UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+		WHERE family_id = $1 AND user_id = $2 AND revoked_at IS NULL`
+	result, err := r.db.ExecContext(ctx, query, sessionID, userID)
+	if err != nil {
+		return false, fmt.Errorf("error revoking session: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error revoking session: %w", err)
+	}
+	return rows > 0, nil
+}
+
+// RevokeAllSessions signs a user out of every session and returns the IDs of
+// the sessions that were still active.
+func (r *repository) RevokeAllSessions(ctx context.Context, userID string) ([]string, error) {
+	sessionIDs := []string{}
+	query := `
+		WITH revoked AS (
+			UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP
+			WHERE user_id = $1 AND revoked_at IS NULL
+			RETURNING family_id, rotated_at, expires_at
+		)
+		SELECT DISTINCT family_id FROM revoked
+		WHERE rotated_at IS NULL AND expires_at > CURRENT_TIMESTAMP`
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error revoking sessions: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sessionID string
+		if err := rows.Scan(&sessionID); err != nil {
+			return nil, fmt.Errorf("error scanning session row: %w", err)
+		}
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over session rows: %w", err)
+	}
+
+	return sessionIDs, nil
+}
+
+// DeleteEndedSessions deletes refresh tokens that can no longer be used and
+// returns how many were deleted. Rotated tokens are kept until they expire,
+// so reusing a leaked one is still detected, and so is the first token of a
+// live session, whose creation is the sign-in time ListSessions reports.
+func (r *repository) DeleteEndedSessions(ctx context.Context) (int64, error) {
+	query := `
+		DELETE FROM sessions s
+		WHERE (s.revoked_at IS NOT NULL OR s.expires_at <= CURRENT_TIMESTAMP)
+		AND NOT (
+			s.revoked_at IS NULL
+			AND s.created_at = (SELECT MIN(f.created_at) FROM sessions f WHERE f.family_id = s.family_id)
+			AND EXISTS (
+				SELECT 1 FROM sessions live
+				WHERE live.family_id = s.family_id AND live.rotated_at IS NULL
+				AND live.revoked_at IS NULL AND live.expires_at > CURRENT_TIMESTAMP
+			)
+		)`
+	result, err := r.db.ExecContext(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting ended sessions: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error deleting ended sessions: %w", err)
+	}
+	return deleted, nil
+}
+
+// SaveRevocations stores revocations of access tokens lasting ttl, and drops
+// the ones that have run out.
+func (r *repository) SaveRevocations(ctx context.Context, kind string, subjects []string, ttl time.Duration) error {
+	if _, err := r.db.ExecContext(ctx, "DELETE FROM token_revocations WHERE expires_at <= CURRENT_TIMESTAMP"); err != nil {
+		return fmt.Errorf("error pruning token revocations: %w", err)
+	}
+
+	query := `
+		INSERT INTO token_revocations (kind, subject, expires_at)
+		SELECT $1, subject, CURRENT_TIMESTAMP + make_interval(secs => $3)
+		FROM unnest($2::uuid[]) AS subject
+		ON CONFLICT (kind, subject) DO UPDATE SET expires_at = GREATEST(token_revocations.expires_at, EXCLUDED.expires_at)`
+	if _, err := r.db.ExecContext(ctx, query, kind, pq.Array(subjects), ttl.Seconds()); err != nil {
+		return fmt.Errorf("error saving token revocations: %w", err)
+	}
+	return nil
+}
+
+// GetRevocations returns the revocations that have not run out yet.
+func (r *repository) GetRevocations(ctx context.Context) ([]*Revocation, error) {
+	revocations := []*Revocation{}
+	query := `
+		SELECT kind, subject, EXTRACT(EPOCH FROM (expires_at - CURRENT_TIMESTAMP))
+		FROM token_revocations
+		WHERE expires_at > CURRENT_TIMESTAMP`
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("error querying token revocations: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rev Revocation
+		var seconds float64
+		if err := rows.Scan(&rev.Kind, &rev.Subject, &seconds); err != nil {
+			return nil, fmt.Errorf("error scanning token revocation row: %w", err)
+		}
+		rev.ExpiresIn = time.Duration(seconds * float64(time.Second))
+		revocations = append(revocations, &rev)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over token revocation rows: %w", err)
+	}
+
+	return revocations, nil
+}
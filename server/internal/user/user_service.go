@@ -1,26 +1,57 @@
 package user
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
 	"log"
-	"server/config"
+	"server/internal/storage"
 	"server/util"
 	"time"
 
-	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Limits for uploaded avatar images
+const (
+	maxAvatarSize      = 5 << 20 // Bytes
+	maxAvatarDimension = 4096    // Pixels per side
+)
+
+var (
+	errInvalidImage        = errors.New("invalid_image")
+	errImageTooLarge       = errors.New("image_too_large")
+	errUserNotFound        = errors.New("user_not_found")
+	errSessionNotFound     = errors.New("session_not_found")
+	errInvalidRefreshToken = errors.New("invalid_refresh_token")
+	errRefreshRateLimited  = errors.New("refresh_rate_limited")
+)
+
 type service struct {
 	Repository
 	timeout time.Duration
+	storage storage.Storage
+	tokens  *util.TokenIssuer
 }
 
-func NewService(repository Repository) Service {
+func NewService(repository Repository, store storage.Storage, tokens *util.TokenIssuer) Service {
 	return &service{
 		repository,
 		time.Duration(2) * time.Second,
+		store,
+		tokens,
 	}
 }
 
@@ -97,7 +128,8 @@ func (s *service) CreateUser(c context.Context, req *CreateUserReq) (*CreateUser
     return res, nil
 }
 
-func (s *service) Login(c context.Context, req *LoginUserReq) (*LoginUserRes, error) {
+// Login checks the user's credentials and starts a session on the client.
+func (s *service) Login(c context.Context, req *LoginUserReq, client ClientInfo) (*LoginUserRes, error) {
 	ctx, cancel := context.WithTimeout(c, s.timeout)
 	defer cancel()
 
@@ -128,24 +160,19 @@ func (s *service) Login(c context.Context, req *LoginUserReq) (*LoginUserRes, er
 
 	log.Printf("Password validated successfully for user ID=%s", u.ID)
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, util.MyJWTClaims{
-		ID:       u.ID,
-		Username: u.Username,
-		RegisteredClaims: jwt.RegisteredClaims{
-			Issuer:    u.ID,
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-		},
-	})
-
-	ss, err := token.SignedString([]byte(config.GetSecretKey()))
+	tokens, err := s.StartSession(ctx, u.ID, u.Username, client)
 	if err != nil {
-		log.Printf("Error signing token for user ID=%s: %v", u.ID, err)
+		log.Printf("Error starting session for user ID=%s: %v", u.ID, err)
 		return nil, err
 	}
 
 	log.Printf("Token generated successfully for user ID=%s", u.ID)
 
-	return &LoginUserRes{accessToken: ss, Username: u.Username, ID: u.ID}, nil
+	return &LoginUserRes{
+		TokenPair: *tokens,
+		ID:        u.ID,
+		Username:  u.Username,
+	}, nil
 }
 
 func (s *service) SearchUsers(ctx context.Context, query string) ([]*User, error) {
@@ -159,3 +186,350 @@ func (s *service) SearchUsers(ctx context.Context, query string) ([]*User, error
 	log.Printf("SearchUsers completed successfully: %d users found", len(users))
 	return users, nil
 }
+
+// UpdateAvatar validates a PNG, JPEG or GIF image, stores a square PNG of every
+// size in util.AvatarSizes and makes it the user's avatar.
+func (s *service) UpdateAvatar(c context.Context, userID string, data []byte) (string, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Rejected avatar of user %s: %v", userID, err)
+		return "", errInvalidImage
+	}
+	// Checked before decoding, so small files cannot expand into huge images
+	if cfg.Width > maxAvatarDimension || cfg.Height > maxAvatarDimension {
+		return "", errImageTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Rejected %s avatar of user %s: %v", format, userID, err)
+		return "", errInvalidImage
+	}
+
+	avatarID := uuid.New().String()
+	for _, size := range util.AvatarSizes {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, util.ResizeSquare(img, size)); err != nil {
+			return "", fmt.Errorf("failed to encode avatar: %w", err)
+		}
+		key := util.AvatarKey(avatarID, size)
+		if err := s.storage.Put(c, key, &buf, int64(buf.Len()), "image/png"); err != nil {
+			s.deleteAvatarFiles(avatarID)
+			return "", fmt.Errorf("failed to store avatar: %w", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c, s.timeout)
+	defer cancel()
+
+	previousID, err := s.Repository.SetAvatar(ctx, userID, avatarID)
+	if err != nil {
+		s.deleteAvatarFiles(avatarID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", errUserNotFound
+		}
+		return "", err
+	}
+	s.deleteAvatarFiles(previousID)
+
+	log.Printf("Avatar of user %s updated from %dx%d %s image", userID, cfg.Width, cfg.Height, format)
+	return util.AvatarURL(avatarID), nil
+}
+
+// DeleteAvatar removes the user's avatar.
+func (s *service) DeleteAvatar(c context.Context, userID string) error {
+	ctx, cancel := context.WithTimeout(c, s.timeout)
+	defer cancel()
+
+	previousID, err := s.Repository.SetAvatar(ctx, userID, "")
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errUserNotFound
+		}
+		return err
+	}
+	s.deleteAvatarFiles(previousID)
+	return nil
+}
+
+// GetAvatar opens a stored avatar variant. The caller must close it.
+func (s *service) GetAvatar(c context.Context, avatarID string, size int) (io.ReadCloser, error) {
+	return s.storage.Get(c, util.AvatarKey(avatarID, size))
+}
+
+// deleteAvatarFiles removes all variants of an avatar. Failures only leave
+// unreferenced files behind, so they are logged and ignored.
+func (s *service) deleteAvatarFiles(avatarID string) {
+	if avatarID == "" {
+		return
+	}
+	for _, size := range util.AvatarSizes {
+		if err := s.storage.Delete(context.Background(), util.AvatarKey(avatarID, size)); err != nil {
+			log.Printf("Error deleting avatar file: %v", err)
+		}
+	}
+}
+
+// StartSession signs the user in on a new device and issues its first token pair.
+func (s *service) StartSession(c context.Context, userID string, username string, client ClientInfo) (*TokenPair, error) {
+	ctx, cancel := context.WithTimeout(c, s.timeout)
+	defer cancel()
+
+	refreshToken, tokenHash, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	sessionID := uuid.New().String()
+	if err := s.Repository.CreateSession(ctx, sessionID, userID, tokenHash, client, s.tokens.RefreshTokenTTL()); err != nil {
+		return nil, err
+	}
+
+	accessToken, err := s.tokens.IssueAccessToken(userID, username, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate access token: %w", err)
+	}
+
+	log.Printf("Session %s started for user %s", sessionID, userID)
+	return &TokenPair{AccessToken: accessToken, RefreshToken: refreshToken}, nil
+}
+
+// RefreshSession exchanges a refresh token for a new token pair. A refresh
+// token that was already exchanged means a copy of it leaked, so presenting it
+// again revokes the whole session.
+func (s *service) RefreshSession(c context.Context, refreshToken string, client ClientInfo) (*TokenPair, error) {
+	ctx, cancel := context.WithTimeout(c, s.timeout)
+	defer cancel()
+
+	token, err := s.Repository.GetSessionToken(ctx, hashRefreshToken(refreshToken))
+	if errors.Is(err, errSessionNotFound) {
+		return nil, errInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case token.Revoked || token.Expired:
+		return nil, errInvalidRefreshToken
+	case token.Rotated:
+		log.Printf("Refresh token reuse detected for session %s of user %s, revoking the session", token.FamilyID, token.UserID)
+		if err := s.revokeSessions(ctx, token.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, errInvalidRefreshToken
+	}
+
+	if !util.RefreshRateLimiter.Allow(token.FamilyID) {
+		return nil, errRefreshRateLimited
+	}
+
+	newToken, newHash, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	rotated, err := s.Repository.RotateSessionToken(ctx, token.ID, newHash, client, s.tokens.RefreshTokenTTL())
+	if err != nil {
+		return nil, err
+	}
+	if !rotated {
+		// Another request exchanged the same token first
+		log.Printf("Concurrent refresh token reuse detected for session %s of user %s, revoking the session", token.FamilyID, token.UserID)
+		if err := s.revokeSessions(ctx, token.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, errInvalidRefreshToken
+	}
+
+	accessToken, err := s.tokens.IssueAccessToken(token.UserID, token.Username, token.FamilyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate access token: %w", err)
+	}
+
+	log.Printf("Session %s of user %s refreshed", token.FamilyID, token.UserID)
+	return &TokenPair{AccessToken: accessToken, RefreshToken: newToken}, nil
+}
+
+// ListSessions returns the active sessions of a user, marking the one with
+// currentSessionID as current.
+func (s *service) ListSessions(c context.Context, userID string, currentSessionID string) ([]*Session, error) {
+	ctx, cancel := context.WithTimeout(c, s.timeout)
+	defer cancel()
+
+	sessions, err := s.Repository.ListSessions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		session.Current = session.ID == currentSessionID
+	}
+	return sessions, nil
+}
+
+// RevokeSession signs the user out of one session. Its refresh tokens stop
+// working immediately; its access tokens stop working on this server at once
+// and on other instances when they next reload the revocation list.
+func (s *service) RevokeSession(c context.Context, userID string, sessionID string) error {
+	ctx, cancel := context.WithTimeout(c, s.timeout)
+	defer cancel()
+
+	if _, err := uuid.Parse(sessionID); err != nil {
+		return errSessionNotFound
+	}
+	revoked, err := s.Repository.RevokeSession(ctx, userID, sessionID)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return errSessionNotFound
+	}
+	if err := s.revokeAccessTokens(ctx, revocationSession, sessionID); err != nil {
+		return err
+	}
+
+	log.Printf("Session %s of user %s revoked", sessionID, userID)
+	return nil
+}
+
+// Logout ends the session the request was made from and revokes the access
+// token it was made with. Tokens issued without a session only have the
+// token itself revoked.
+func (s *service) Logout(c context.Context, userID string, sessionID string, tokenID string) error {
+	ctx, cancel := context.WithTimeout(c, s.timeout)
+	defer cancel()
+
+	if tokenID != "" {
+		if err := s.revokeAccessTokens(ctx, revocationToken, tokenID); err != nil {
+			return err
+		}
+	}
+	if sessionID != "" {
+		if err := s.revokeSessions(ctx, sessionID); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("User %s logged out of session %s", userID, sessionID)
+	return nil
+}
+
+// LogoutAllSessions signs the user out on every device and returns the number
+// of sessions that were ended.
+func (s *service) LogoutAllSessions(c context.Context, userID string) (int, error) {
+	ctx, cancel := context.WithTimeout(c, s.timeout)
+	defer cancel()
+
+	sessionIDs, err := s.Repository.RevokeAllSessions(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.revokeAccessTokens(ctx, revocationSession, sessionIDs...); err != nil {
+		return 0, err
+	}
+
+	log.Printf("User %s logged out of %d sessions", userID, len(sessionIDs))
+	return len(sessionIDs), nil
+}
+
+// LoadRevocations restores the revocation list checked by TokenIssuer.ValidateToken
+// from the database, so revoked tokens stay rejected after a restart.
+func (s *service) LoadRevocations(c context.Context) error {
+	ctx, cancel := context.WithTimeout(c, s.timeout)
+	defer cancel()
+
+	revocations, err := s.Repository.GetRevocations(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, rev := range revocations {
+		switch rev.Kind {
+		case revocationToken:
+			util.RevokedTokens.RevokeToken(rev.Subject, now.Add(rev.ExpiresIn))
+		case revocationSession:
+			util.RevokedTokens.RevokeSession(rev.Subject, now.Add(rev.ExpiresIn))
+		}
+	}
+	return nil
+}
+
+// SyncRevocations reloads the revocation list every interval until ctx is
+// done, so tokens revoked through another server instance are rejected here too.
+func (s *service) SyncRevocations(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.LoadRevocations(ctx); err != nil {
+				log.Printf("Error reloading token revocations: %v", err)
+			}
+		}
+	}
+}
+
+// PruneSessions deletes the refresh tokens of ended sessions every interval
+// until ctx is done, as every refresh stores a new token.
+func (s *service) PruneSessions(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := s.Repository.DeleteEndedSessions(ctx)
+			if err != nil {
+				log.Printf("Error pruning sessions: %v", err)
+			} else if deleted > 0 {
+				log.Printf("Pruned %d refresh tokens of ended sessions", deleted)
+			}
+		}
+	}
+}
+
+// revokeSessions ends sessions: their refresh tokens and the access tokens
+// already issued for them stop working.
+func (s *service) revokeSessions(ctx context.Context, sessionIDs ...string) error {
+	for _, sessionID := range sessionIDs {
+		if err := s.Repository.RevokeSessionFamily(ctx, sessionID); err != nil {
+			return err
+		}
+	}
+	return s.revokeAccessTokens(ctx, revocationSession, sessionIDs...)
+}
+
+// revokeAccessTokens rejects access tokens by token or session ID until they
+// expire. The list is updated in memory first, so this server rejects the
+// tokens even if saving them fails.
+func (s *service) revokeAccessTokens(ctx context.Context, kind string, subjects ...string) error {
+	if len(subjects) == 0 {
+		return nil
+	}
+	until := time.Now().Add(s.tokens.AccessTokenTTL())
+	for _, subject := range subjects {
+		if kind == revocationToken {
+			util.RevokedTokens.RevokeToken(subject, until)
+		} else {
+			util.RevokedTokens.RevokeSession(subject, until)
+		}
+	}
+	return s.Repository.SaveRevocations(ctx, kind, subjects, s.tokens.AccessTokenTTL())
+}
+
+// newRefreshToken returns a random refresh token and the hash it is stored under.
+func newRefreshToken() (token string, hash string, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+	token = base64.RawURLEncoding.EncodeToString(buf)
+	return token, hashRefreshToken(token), nil
+}
+
+// hashRefreshToken returns the hex SHA-256 of a refresh token. Tokens carry
+// 256 random bits, so a fast unsalted hash is enough.
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
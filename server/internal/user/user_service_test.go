@@ -0,0 +1,400 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"server/util"
+
+	"github.com/google/uuid"
+)
+
+// fakeSession is a stored refresh token.
+type fakeSession struct {
+	SessionToken
+	hash      string
+	expiresAt time.Time
+}
+
+// fakeRepository keeps sessions and revocations in memory. Methods the tests
+// do not use are left to the embedded nil Repository and panic.
+type fakeRepository struct {
+	Repository
+	mu          sync.Mutex
+	sessions    []*fakeSession
+	revocations []*Revocation
+	loseRotate  bool // Report every rotation as lost to a concurrent refresh
+}
+
+func (r *fakeRepository) CreateSession(ctx context.Context, familyID string, userID string, tokenHash string, client ClientInfo, ttl time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions = append(r.sessions, &fakeSession{
+		SessionToken: SessionToken{ID: uuid.New().String(), FamilyID: familyID, UserID: userID, Username: "alice"},
+		hash:         tokenHash,
+		expiresAt:    time.Now().Add(ttl),
+	})
+	return nil
+}
+
+func (r *fakeRepository) GetSessionToken(ctx context.Context, tokenHash string) (*SessionToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.sessions {
+		if s.hash == tokenHash {
+			token := s.SessionToken
+			token.Expired = !time.Now().Before(s.expiresAt)
+			return &token, nil
+		}
+	}
+	return nil, errSessionNotFound
+}
+
+func (r *fakeRepository) RotateSessionToken(ctx context.Context, tokenID string, newTokenHash string, client ClientInfo, ttl time.Duration) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.loseRotate {
+		return false, nil
+	}
+	for _, s := range r.sessions {
+		if s.ID == tokenID && !s.Rotated && !s.Revoked && time.Now().Before(s.expiresAt) {
+			s.Rotated = true
+			r.sessions = append(r.sessions, &fakeSession{
+				SessionToken: SessionToken{ID: uuid.New().String(), FamilyID: s.FamilyID, UserID: s.UserID, Username: s.Username},
+				hash:         newTokenHash,
+				expiresAt:    time.Now().Add(ttl),
+			})
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *fakeRepository) RevokeSessionFamily(ctx context.Context, familyID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.sessions {
+		if s.FamilyID == familyID {
+			s.Revoked = true
+		}
+	}
+	return nil
+}
+
+func (r *fakeRepository) RevokeSession(ctx context.Context, userID string, sessionID string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	revoked := false
+	for _, s := range r.sessions {
+		if s.FamilyID == sessionID && s.UserID == userID && !s.Revoked {
+			s.Revoked, revoked = true, true
+		}
+	}
+	return revoked, nil
+}
+
+func (r *fakeRepository) RevokeAllSessions(ctx context.Context, userID string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sessionIDs := []string{}
+	for _, s := range r.sessions {
+		if s.UserID != userID || s.Revoked {
+			continue
+		}
+		s.Revoked = true
+		if !s.Rotated && time.Now().Before(s.expiresAt) {
+			sessionIDs = append(sessionIDs, s.FamilyID)
+		}
+	}
+	return sessionIDs, nil
+}
+
+func (r *fakeRepository) SaveRevocations(ctx context.Context, kind string, subjects []string, ttl time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, subject := range subjects {
+		r.revocations = append(r.revocations, &Revocation{Kind: kind, Subject: subject, ExpiresIn: ttl})
+	}
+	return nil
+}
+
+func (r *fakeRepository) GetRevocations(ctx context.Context) ([]*Revocation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Revocation{}, r.revocations...), nil
+}
+
+// family returns the stored tokens of a session.
+func (r *fakeRepository) family(familyID string) []*fakeSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var tokens []*fakeSession
+	for _, s := range r.sessions {
+		if s.FamilyID == familyID {
+			tokens = append(tokens, s)
+		}
+	}
+	return tokens
+}
+
+func newTestService(t *testing.T) (*service, *fakeRepository) {
+	t.Helper()
+	tokens, err := util.NewTokenIssuer(util.TokenIssuerOptions{
+		Issuer:          "test",
+		Audience:        "test-api",
+		AccessTokenTTL:  time.Minute,
+		RefreshTokenTTL: time.Hour,
+		SigningKey:      util.TokenKey{ID: "test", Secret: []byte("secret")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &fakeRepository{}
+	return NewService(repo, nil, tokens).(*service), repo
+}
+
+// startSession signs a new user in and returns the user ID, session ID and tokens.
+func startSession(t *testing.T, s *service) (string, string, *TokenPair) {
+	t.Helper()
+	userID := uuid.New().String()
+	pair, err := s.StartSession(context.Background(), userID, "alice", ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := s.tokens.ValidateToken(pair.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userID, claims.SessionID, pair
+}
+
+func TestRefreshSessionRotatesToken(t *testing.T) {
+	s, repo := newTestService(t)
+	ctx := context.Background()
+	_, sessionID, first := startSession(t, s)
+
+	second, err := s.RefreshSession(ctx, first.RefreshToken, ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.RefreshToken == first.RefreshToken {
+		t.Error("refresh token was not rotated")
+	}
+	claims, err := s.tokens.ValidateToken(second.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.SessionID != sessionID {
+		t.Errorf("session ID = %s, want %s", claims.SessionID, sessionID)
+	}
+
+	// Presenting the rotated token again means it leaked
+	if _, err := s.RefreshSession(ctx, first.RefreshToken, ClientInfo{}); !errors.Is(err, errInvalidRefreshToken) {
+		t.Fatalf("reused token: err = %v, want %v", err, errInvalidRefreshToken)
+	}
+	for _, token := range repo.family(sessionID) {
+		if !token.Revoked {
+			t.Errorf("token %s of the session was not revoked", token.ID)
+		}
+	}
+	if _, err := s.RefreshSession(ctx, second.RefreshToken, ClientInfo{}); !errors.Is(err, errInvalidRefreshToken) {
+		t.Errorf("latest token after reuse: err = %v, want %v", err, errInvalidRefreshToken)
+	}
+	if _, err := s.tokens.ValidateToken(second.AccessToken); !errors.Is(err, util.ErrTokenRevoked) {
+		t.Errorf("access token after reuse: err = %v, want %v", err, util.ErrTokenRevoked)
+	}
+}
+
+func TestRefreshSessionRevokesOnConcurrentUse(t *testing.T) {
+	s, repo := newTestService(t)
+	_, sessionID, pair := startSession(t, s)
+
+	// Another request rotated the token between the lookup and the rotation
+	repo.loseRotate = true
+	if _, err := s.RefreshSession(context.Background(), pair.RefreshToken, ClientInfo{}); !errors.Is(err, errInvalidRefreshToken) {
+		t.Fatalf("err = %v, want %v", err, errInvalidRefreshToken)
+	}
+	for _, token := range repo.family(sessionID) {
+		if !token.Revoked {
+			t.Errorf("token %s of the session was not revoked", token.ID)
+		}
+	}
+	if _, err := s.tokens.ValidateToken(pair.AccessToken); !errors.Is(err, util.ErrTokenRevoked) {
+		t.Errorf("access token: err = %v, want %v", err, util.ErrTokenRevoked)
+	}
+}
+
+func TestRefreshSessionRejectsInvalidTokens(t *testing.T) {
+	s, repo := newTestService(t)
+	ctx := context.Background()
+
+	_, expiredSession, expired := startSession(t, s)
+	repo.family(expiredSession)[0].expiresAt = time.Now().Add(-time.Second)
+
+	userID, revokedSession, revoked := startSession(t, s)
+	if err := s.RevokeSession(ctx, userID, revokedSession); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"expired", expired.RefreshToken},
+		{"revoked", revoked.RefreshToken},
+		{"unknown", "not-a-refresh-token"},
+	}
+	for _, tt := range tests {
+		if _, err := s.RefreshSession(ctx, tt.token, ClientInfo{}); !errors.Is(err, errInvalidRefreshToken) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, errInvalidRefreshToken)
+		}
+	}
+	if repo.family(expiredSession)[0].Rotated {
+		t.Error("an expired token was rotated")
+	}
+}
+
+// tokenID returns the jti of a valid access token.
+func tokenID(t *testing.T, s *service, accessToken string) string {
+	t.Helper()
+	claims, err := s.tokens.ValidateToken(accessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claims.RegisteredClaims.ID
+}
+
+func TestLogoutRevokesTokenID(t *testing.T) {
+	s, _ := newTestService(t)
+	ctx := context.Background()
+
+	// A token without a session can only be revoked by its ID
+	revoked, err := s.tokens.IssueAccessToken("user", "alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.tokens.IssueAccessToken("user", "alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Logout(ctx, "user", "", tokenID(t, s, revoked)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.tokens.ValidateToken(revoked); !errors.Is(err, util.ErrTokenRevoked) {
+		t.Errorf("revoked token: err = %v, want %v", err, util.ErrTokenRevoked)
+	}
+	if _, err := s.tokens.ValidateToken(other); err != nil {
+		t.Errorf("other token: %v", err)
+	}
+
+	// Logging out of a session also ends its refresh token
+	userID, sessionID, pair := startSession(t, s)
+	if err := s.Logout(ctx, userID, sessionID, tokenID(t, s, pair.AccessToken)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.tokens.ValidateToken(pair.AccessToken); !errors.Is(err, util.ErrTokenRevoked) {
+		t.Errorf("access token after logout: err = %v, want %v", err, util.ErrTokenRevoked)
+	}
+	if _, err := s.RefreshSession(ctx, pair.RefreshToken, ClientInfo{}); !errors.Is(err, errInvalidRefreshToken) {
+		t.Errorf("refresh after logout: err = %v, want %v", err, errInvalidRefreshToken)
+	}
+}
+
+func TestRevokeSessionRejectsEveryToken(t *testing.T) {
+	s, _ := newTestService(t)
+	ctx := context.Background()
+	userID, sessionID, pair := startSession(t, s)
+	_, _, otherPair := startSession(t, s)
+
+	// Every access token issued for the session, not only the latest
+	second, err := s.tokens.IssueAccessToken(userID, "alice", sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RevokeSession(ctx, userID, sessionID); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{pair.AccessToken, second} {
+		if _, err := s.tokens.ValidateToken(token); !errors.Is(err, util.ErrTokenRevoked) {
+			t.Errorf("token of the revoked session: err = %v, want %v", err, util.ErrTokenRevoked)
+		}
+	}
+	if _, err := s.tokens.ValidateToken(otherPair.AccessToken); err != nil {
+		t.Errorf("token of another session: %v", err)
+	}
+
+	if err := s.RevokeSession(ctx, "someone-else", sessionID); !errors.Is(err, errSessionNotFound) {
+		t.Errorf("revoking again: err = %v, want %v", err, errSessionNotFound)
+	}
+}
+
+func TestLogoutAllSessionsRevokesEverySession(t *testing.T) {
+	s, _ := newTestService(t)
+	ctx := context.Background()
+	userID, _, first := startSession(t, s)
+	second, err := s.StartSession(ctx, userID, "alice", ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A rotated session is still one session
+	second, err = s.RefreshSession(ctx, second.RefreshToken, ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, other := startSession(t, s)
+
+	count, err := s.LogoutAllSessions(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("ended %d sessions, want 2", count)
+	}
+	for _, pair := range []*TokenPair{first, second} {
+		if _, err := s.tokens.ValidateToken(pair.AccessToken); !errors.Is(err, util.ErrTokenRevoked) {
+			t.Errorf("access token: err = %v, want %v", err, util.ErrTokenRevoked)
+		}
+		if _, err := s.RefreshSession(ctx, pair.RefreshToken, ClientInfo{}); !errors.Is(err, errInvalidRefreshToken) {
+			t.Errorf("refresh: err = %v, want %v", err, errInvalidRefreshToken)
+		}
+	}
+	if _, err := s.tokens.ValidateToken(other.AccessToken); err != nil {
+		t.Errorf("token of another user: %v", err)
+	}
+}
+
+func TestLoadRevocationsRestoresList(t *testing.T) {
+	s, _ := newTestService(t)
+	ctx := context.Background()
+	userID, sessionID, pair := startSession(t, s)
+	single, err := s.tokens.IssueAccessToken(userID, "alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RevokeSession(ctx, userID, sessionID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Logout(ctx, userID, "", tokenID(t, s, single)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restart starts with an empty list
+	saved := util.RevokedTokens
+	util.RevokedTokens = util.NewRevocationList()
+	t.Cleanup(func() { util.RevokedTokens = saved })
+	if _, err := s.tokens.ValidateToken(pair.AccessToken); err != nil {
+		t.Fatalf("before loading: %v", err)
+	}
+
+	if err := s.LoadRevocations(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{pair.AccessToken, single} {
+		if _, err := s.tokens.ValidateToken(token); !errors.Is(err, util.ErrTokenRevoked) {
+			t.Errorf("after loading: err = %v, want %v", err, util.ErrTokenRevoked)
+		}
+	}
+}
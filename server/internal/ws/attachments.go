@@ -0,0 +1,387 @@
+package ws
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"server/config"
+	"server/internal/storage"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const (
+	maxAttachmentsPerMessage = 10
+	maxFilenameLength        = 255
+)
+
+var errInvalidAttachment = fmt.Errorf("attachmentIDs must reference at most %d of your own unsent uploads to this chat", maxAttachmentsPerMessage)
+
+// allowedAttachmentTypes lists the sniffed media types accepted for upload.
+// Types a browser would render as active content, such as HTML, are rejected,
+// and so is application/octet-stream, which is what anything unrecognized
+// sniffs as.
+var allowedAttachmentTypes = map[string]bool{
+	"image/png":          true,
+	"image/jpeg":         true,
+	"image/gif":          true,
+	"image/webp":         true,
+	"image/bmp":          true,
+	"audio/mpeg":         true,
+	"audio/wave":         true,
+	"audio/ogg":          true,
+	"video/mp4":          true,
+	"video/webm":         true,
+	"application/pdf":    true,
+	"application/zip":    true,
+	"application/x-gzip": true,
+	"text/plain":         true,
+}
+
+// Attachment is a file attached to a message.
+type Attachment struct {
+	ID          string `json:"id"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"` // Size in bytes
+	URL         string `json:"url"`  // Download path; requires chat membership
+}
+
+// attachmentURL returns the download path of an attachment.
+func attachmentURL(id string) string {
+	return "/ws/attachments/" + id
+}
+
+// sanitizeFilename keeps the base name of an uploaded file without control
+// characters, shortened to maxFilenameLength characters.
+func sanitizeFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	if utf8.RuneCountInString(name) > maxFilenameLength {
+		name = string([]rune(name)[:maxFilenameLength])
+	}
+	return name
+}
+
+// sniffContentType detects the media type of the file from its first bytes
+// and rewinds it.
+func sniffContentType(file io.ReadSeeker) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// UploadAttachment stores a file uploaded as the multipart field "file" for
+// the chat. The returned attachment ID is passed in attachmentIDs when sending
+// the message it belongs to.
+func (h *Handler) UploadAttachment(c *gin.Context) {
+	chatID := c.Param("chatID")
+	userID := c.GetString("userID")
+
+	// Leave room for the multipart headers around the file
+	maxSize := config.GetMaxUploadSize()
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSize+64<<10)
+
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Files must be at most %d bytes", maxSize)})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A file is required"})
+		return
+	}
+	defer file.Close()
+
+	if header.Size > maxSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Files must be at most %d bytes", maxSize)})
+		return
+	}
+	if header.Size == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File is empty"})
+		return
+	}
+
+	// The client-provided Content-Type is ignored
+	contentType, err := sniffContentType(file)
+	if err != nil {
+		log.Printf("Error reading upload from user %s: %v", userID, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if !allowedAttachmentTypes[mediaType] {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": fmt.Sprintf("Files of type %s are not allowed", mediaType)})
+		return
+	}
+
+	attachment := Attachment{
+		ID:          uuid.New().String(),
+		Filename:    sanitizeFilename(header.Filename),
+		ContentType: contentType,
+		Size:        header.Size,
+	}
+	attachment.URL = attachmentURL(attachment.ID)
+	key := "attachments/" + chatID + "/" + attachment.ID
+
+	if err := h.storage.Put(c.Request.Context(), key, file, header.Size, contentType); err != nil {
+		log.Printf("Error storing attachment %s: %v", attachment.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store file"})
+		return
+	}
+
+	_, err = h.db.Exec(`
+		INSERT INTO attachments (id, chat_id, uploader_id, storage_key, filename, content_type, size)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		attachment.ID, chatID, userID, key, attachment.Filename, attachment.ContentType, attachment.Size)
+	if err != nil {
+		log.Printf("Error saving attachment %s: %v", attachment.ID, err)
+		h.deleteStoredFiles(key)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store file"})
+		return
+	}
+
+	log.Printf("User %s uploaded attachment %s (%s, %d bytes) to chat %s", userID, attachment.ID, mediaType, attachment.Size, chatID)
+	c.JSON(http.StatusCreated, attachment)
+}
+
+// DownloadAttachment streams an attachment to a member of its chat. Uploads
+// that are not attached to a message yet are only visible to the uploader.
+func (h *Handler) DownloadAttachment(c *gin.Context) {
+	attachmentID := c.Param("id")
+	userID := c.GetString("userID")
+
+	if _, err := uuid.Parse(attachmentID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+
+	var chatID, uploaderID, key, filename, contentType string
+	var messageID sql.NullString
+	var size int64
+	err := h.db.QueryRow(`
+		SELECT chat_id, message_id, uploader_id, storage_key, filename, content_type, size
+		FROM attachments
+		WHERE id = $1`, attachmentID).Scan(&chatID, &messageID, &uploaderID, &key, &filename, &contentType, &size)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading attachment %s: %v", attachmentID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	// Non-members must not learn whether the attachment exists
+	if err := authorizeChatMember(h.db, chatID, userID); err != nil {
+		log.Printf("Access to attachment %s denied for user %s: %v", attachmentID, userID, err)
+		if errors.Is(err, errNotChatMember) || errors.Is(err, errChatNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		}
+		return
+	}
+	if !messageID.Valid && uploaderID != userID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+
+	body, err := h.storage.Get(c.Request.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		log.Printf("Attachment %s is missing from storage", attachmentID)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading attachment %s: %v", attachmentID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+	defer body.Close()
+
+	// Only images are shown inline; browsers must download everything else and
+	// never guess a different type
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") {
+		disposition = "inline"
+	}
+	c.DataFromReader(http.StatusOK, size, contentType, body, map[string]string{
+		"Content-Disposition":     mime.FormatMediaType(disposition, map[string]string{"filename": filename}),
+		"Content-Security-Policy": "sandbox",
+		"X-Content-Type-Options":  "nosniff",
+	})
+}
+
+// linkAttachments attaches the sender's unsent uploads to a new message.
+func linkAttachments(tx *sql.Tx, msg *Message) error {
+	msg.Attachments = []Attachment{}
+	if len(msg.AttachmentIDs) == 0 {
+		return nil
+	}
+
+	ids := uniqueMembers(msg.AttachmentIDs)
+	if len(ids) > maxAttachmentsPerMessage {
+		return errInvalidAttachment
+	}
+	for _, id := range ids {
+		if _, err := uuid.Parse(id); err != nil {
+			return errInvalidAttachment
+		}
+	}
+
+	rows, err := tx.Query(`
+		UPDATE attachments SET message_id = $1
+		WHERE id = ANY($2::uuid[]) AND chat_id = $3 AND uploader_id = $4 AND message_id IS NULL
+		RETURNING id, filename, content_type, size`,
+		msg.ID, pq.Array(ids), msg.RoomID, msg.SenderID)
+	if err != nil {
+		return fmt.Errorf("failed to link attachments: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.ID, &a.Filename, &a.ContentType, &a.Size); err != nil {
+			return fmt.Errorf("failed to scan attachment: %w", err)
+		}
+		a.URL = attachmentURL(a.ID)
+		msg.Attachments = append(msg.Attachments, a)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to link attachments: %w", err)
+	}
+	if len(msg.Attachments) != len(ids) {
+		return errInvalidAttachment
+	}
+	return nil
+}
+
+// loadAttachments returns the attachments of a message, oldest first.
+func loadAttachments(db *sql.DB, messageID string) ([]Attachment, error) {
+	rows, err := db.Query(`
+		SELECT id, filename, content_type, size
+		FROM attachments
+		WHERE message_id = $1
+		ORDER BY created_at, id`, messageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load attachments: %w", err)
+	}
+	defer rows.Close()
+
+	attachments := []Attachment{}
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.ID, &a.Filename, &a.ContentType, &a.Size); err != nil {
+			return nil, fmt.Errorf("failed to scan attachment: %w", err)
+		}
+		a.URL = attachmentURL(a.ID)
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+// deleteAttachments removes the attachments of a message and returns their
+// storage keys, to be deleted once the transaction commits.
+func deleteAttachments(tx *sql.Tx, messageID string) ([]string, error) {
+	rows, err := tx.Query("DELETE FROM attachments WHERE message_id = $1 RETURNING storage_key", messageID)
+	if err != nil {
+		return nil, err
+	}
+	return scanStorageKeys(rows)
+}
+
+// deleteUnsentAttachments removes uploads older than maxAge that were never
+// attached to a message and returns their storage keys. Sending a message
+// links its uploads under a row lock, so an upload is either sent or deleted.
+func deleteUnsentAttachments(ctx context.Context, db *sql.DB, maxAge time.Duration) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		DELETE FROM attachments
+		WHERE message_id IS NULL AND created_at < CURRENT_TIMESTAMP - make_interval(secs => $1)
+		RETURNING storage_key`, maxAge.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	return scanStorageKeys(rows)
+}
+
+// scanStorageKeys reads the storage keys returned by a deletion and closes the rows.
+func scanStorageKeys(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// PruneUnsentAttachments deletes uploads that were not attached to a message
+// within config.GetUnsentAttachmentTTL, and their files, every interval until
+// ctx is done.
+func (h *Handler) PruneUnsentAttachments(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			keys, err := deleteUnsentAttachments(ctx, h.db, config.GetUnsentAttachmentTTL())
+			if err != nil {
+				log.Printf("Error pruning unsent attachments: %v", err)
+			} else if len(keys) > 0 {
+				h.deleteStoredFiles(keys...)
+				log.Printf("Pruned %d unsent attachments", len(keys))
+			}
+		}
+	}
+}
+
+// deleteStoredFiles removes files from storage in the background. Failures
+// only leave unreferenced files behind, so they are logged and ignored.
+func (h *Handler) deleteStoredFiles(keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+	go func() {
+		for _, key := range keys {
+			if err := h.storage.Delete(context.Background(), key); err != nil {
+				log.Printf("Error deleting stored file %s: %v", key, err)
+			}
+		}
+	}()
+}
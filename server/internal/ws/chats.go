@@ -0,0 +1,37 @@
+package ws
+
+import "time"
+
+// maxPreviewLength is the number of characters kept in a last-message preview.
+const maxPreviewLength = 100
+
+// ChatSummary is an entry of the caller's chat list.
+type ChatSummary struct {
+	ID             string          `json:"id"`
+	Name           string          `json:"name"`
+	IsGroup        bool            `json:"isGroup"`
+	AvatarURL      string          `json:"avatarURL,omitempty"`
+	UnreadCount    int             `json:"unreadCount"`           // Messages from others after the caller's read cursor
+	LastMessage    *MessagePreview `json:"lastMessage,omitempty"` // Newest message visible to the caller
+	LastActivityAt time.Time       `json:"lastActivityAt"`        // Time of the last message, or chat creation
+}
+
+// MessagePreview is a shortened view of a message for the chat list.
+type MessagePreview struct {
+	ID        string    `json:"id"`
+	SenderID  string    `json:"senderID"`
+	Username  string    `json:"username"`
+	Kind      string    `json:"kind"`
+	Content   string    `json:"content"` // Empty for system messages
+	CreatedAt time.Time `json:"createdAt"`
+	Deleted   bool      `json:"deleted,omitempty"`
+}
+
+// previewText shortens content to maxPreviewLength characters.
+func previewText(content string) string {
+	runes := []rune(content)
+	if len(runes) <= maxPreviewLength {
+		return content
+	}
+	return string(runes[:maxPreviewLength]) + "…"
+}
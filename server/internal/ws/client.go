@@ -2,48 +2,121 @@ package ws
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"server/internal/user"
+	"sync"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
 type Client struct {
 	Conn     *websocket.Conn
-	Message  chan *Message
+	Send     chan *Envelope
 	ID       string `json:"ID"`
-	RoomID   string `json:"roomID"`
+	RoomID   string `json:"roomID"` // Default chat for legacy single-chat connections
 	Username string `json:"username"`
 	DB       *sql.DB
+	Users    user.Repository // Resolves @username mentions
+
+	mu    sync.Mutex      // Protects rooms
+	rooms map[string]bool // Chats this connection is subscribed to
+	away  bool            // The user reported this connection idle; protected by Hub.mu
+
+	lastPresenceAt time.Time // When the last presence frame was accepted; owned by the read loop
 }
 
 type Message struct {
-	ID        string    `json:"id"`        // Message ID
-	RoomID    string    `json:"roomID"`    // Chat/Room ID
-	SenderID  string    `json:"senderID"`  // Sender's user ID
-	Username  string    `json:"username"`  // Sender's username
-	Content   string    `json:"content"`   // Message content
-	CreatedAt time.Time `json:"createdAt"` // Timestamp of the message
+	ID              string            `json:"id"`                        // Message ID
+	ClientMessageID string            `json:"clientMessageID,omitempty"` // Client-generated idempotency key
+	RoomID          string            `json:"roomID"`                    // Chat/Room ID
+	SenderID        string            `json:"senderID"`                  // Sender's user ID
+	Username        string            `json:"username"`                  // Sender's username
+	Kind            string            `json:"kind"`                      // User or system message
+	Content         string            `json:"content"`                   // Message content
+	Event           *ChatEventPayload `json:"event,omitempty"`           // Chat event of a system message
+	Seq             int64             `json:"seq"`                       // Per-chat sequence number
+	CreatedAt       time.Time         `json:"createdAt"`                 // Timestamp of the message
+	EditedAt        *time.Time        `json:"editedAt,omitempty"`        // Timestamp of the last edit
+	DeletedAt       *time.Time        `json:"deletedAt,omitempty"`       // Timestamp of deletion for everyone
+	ReplyToID       string            `json:"replyToID,omitempty"`       // Message this one replies to
+	ReplyTo         *QuotedMessage    `json:"replyTo,omitempty"`         // Preview of the replied-to message
+	ReplyCount      int               `json:"replyCount"`                // Number of replies to this message
+	Reactions       []Reaction        `json:"reactions"`                 // Aggregated reactions
+	Attachments     []Attachment      `json:"attachments"`               // Attached files
+	AttachmentIDs   []string          `json:"-"`                         // Uploads to attach when saving
+	SeenBy          []string          `json:"seenBy"`                    // Members other than the sender who read this message
+	Mentions        []string          `json:"mentions"`                  // Members mentioned with @username
+	LinkPreviews    []LinkPreview     `json:"linkPreviews,omitempty"`    // Previews of linked pages, once fetched
 }
 
 func (c *Client) writeMessage() {
 	defer c.Conn.Close()
 
-	for msg := range c.Message {
-		err := c.Conn.WriteJSON(msg)
+	for env := range c.Send {
+		err := c.Conn.WriteJSON(env)
 		if err != nil {
-			log.Printf("Error writing WebSocket message to client %s: %v", c.ID, err)
+			log.Printf("Error writing WebSocket frame to client %s: %v", c.ID, err)
 			return
 		}
-		log.Printf("Message sent to client %s: %+v", c.ID, msg)
+		log.Printf("Frame %s sent to client %s", env.Type, c.ID)
+	}
+}
+
+// Rooms returns the IDs of the chats this connection is subscribed to.
+func (c *Client) Rooms() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rooms := make([]string, 0, len(c.rooms))
+	for roomID := range c.rooms {
+		rooms = append(rooms, roomID)
+	}
+	return rooms
+}
+
+// IsSubscribed reports whether this connection receives frames for the chat.
+func (c *Client) IsSubscribed(roomID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rooms[roomID]
+}
+
+func (c *Client) addRoom(roomID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rooms == nil {
+		c.rooms = make(map[string]bool)
 	}
+	c.rooms[roomID] = true
+}
+
+func (c *Client) removeRoom(roomID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.rooms, roomID)
+}
+
+// reply queues a frame for this client only, dropping it if the client is not keeping up.
+func (c *Client) reply(env *Envelope) {
+	select {
+	case c.Send <- env:
+	default:
+		log.Printf("Dropping %s frame for client %s: send buffer full", env.Type, c.ID)
+	}
+}
+
+// replyError sends an error frame in response to the frame with the given ID.
+func (c *Client) replyError(id, code, message string) {
+	c.reply(NewErrorEnvelope(id, code, message))
 }
 
 func (c *Client) readMessage(hub *Hub) {
 	defer func() {
 		// Ensure cleanup on disconnect
-		log.Printf("Client %s disconnected from chat %s", c.ID, c.RoomID)
+		log.Printf("Client %s closed its connection", c.ID)
 		hub.Unregister <- c
 		c.Conn.Close()
 	}()
@@ -68,30 +141,242 @@ func (c *Client) readMessage(hub *Hub) {
 			break
 		}
 
-		// Create a new message object
-		msg := &Message{
-			ID:        uuid.New().String(),
-			RoomID:    c.RoomID,
-			SenderID:  c.ID,
-			Username:  c.Username,
-			Content:   string(messageBytes),
-			CreatedAt: time.Now(),
+		env, err := DecodeEnvelope(messageBytes)
+		if err != nil {
+			log.Printf("Rejected frame from client %s: %v", c.ID, err)
+			if errors.Is(err, ErrUnsupportedVersion) {
+				c.replyError(env.ID, ErrCodeUnsupportedVersion, fmt.Sprintf("Protocol version %d is not supported", env.Version))
+			} else {
+				c.replyError("", ErrCodeMalformedFrame, "Frame is not a valid envelope")
+			}
+			continue
+		}
+
+		c.handleFrame(hub, env)
+	}
+}
+
+// handleFrame dispatches a decoded inbound frame by its type.
+func (c *Client) handleFrame(hub *Hub, env *Envelope) {
+	switch env.Type {
+	case FrameMessage:
+		c.handleChatMessage(hub, env)
+	case FrameSubscribe:
+		c.handleSubscribe(hub, env)
+	case FrameUnsubscribe:
+		c.handleUnsubscribe(hub, env)
+	case FrameRead:
+		c.handleRead(hub, env)
+	case FramePresence:
+		c.handlePresence(hub, env)
+	case FrameTypingStart:
+		c.handleTyping(hub, env, true)
+	case FrameTypingStop:
+		c.handleTyping(hub, env, false)
+	default:
+		log.Printf("Unknown frame type %q from client %s", env.Type, c.ID)
+		c.replyError(env.ID, ErrCodeUnknownType, fmt.Sprintf("Unknown frame type %q", env.Type))
+	}
+}
+
+// handleChatMessage persists an inbound chat message and broadcasts it to the room.
+func (c *Client) handleChatMessage(hub *Hub, env *Envelope) {
+	var payload MessagePayload
+	if err := env.DecodePayload(&payload); err != nil {
+		c.replyError(env.ID, ErrCodeInvalidPayload, err.Error())
+		return
+	}
+	roomID := payload.RoomID
+	if roomID == "" {
+		roomID = c.RoomID
+	}
+	if roomID == "" || !c.IsSubscribed(roomID) {
+		c.replyError(env.ID, ErrCodeNotSubscribed, "Subscribe to the chat before sending messages")
+		return
+	}
+
+	// The client message ID makes retries after a reconnect idempotent
+	clientMessageID := payload.ClientMessageID
+	if clientMessageID == "" {
+		clientMessageID = env.ID
+	}
+
+	msg := &Message{
+		ClientMessageID: clientMessageID,
+		ReplyToID:       payload.ReplyToID,
+		RoomID:          roomID,
+		SenderID:        c.ID,
+		Username:        c.Username,
+		Content:         payload.Content,
+		AttachmentIDs:   payload.AttachmentIDs,
+	}
+
+	// Save the message to the database
+	duplicate, err := saveMessage(c.DB, c.Users, msg)
+	if err != nil {
+		log.Printf("Failed to save message from client %s to database: %v", c.ID, err)
+		switch {
+		case isInvalidMessageError(err):
+			c.replyError(env.ID, ErrCodeInvalidPayload, err.Error())
+		case errors.Is(err, errChatNotFound):
+			c.replyError(env.ID, ErrCodeNotFound, "Chat not found")
+		default:
+			c.replyError(env.ID, ErrCodeInternal, "Failed to save message")
+		}
+		return
+	}
+
+	createdAt := msg.CreatedAt
+	c.ackWith(env.ID, AckPayload{ID: env.ID, MessageID: msg.ID, CreatedAt: &createdAt, Duplicate: duplicate})
+
+	if duplicate {
+		log.Printf("Duplicate message %s from client %s acknowledged without rebroadcast", clientMessageID, c.ID)
+		return
+	}
+	log.Printf("Message saved to database: %+v", msg)
+
+	// Broadcast the message to other clients in the chat room
+	hub.Broadcast <- msg
+}
+
+// handleSubscribe subscribes this connection to a chat the user is a member of.
+func (c *Client) handleSubscribe(hub *Hub, env *Envelope) {
+	var payload SubscriptionPayload
+	if err := env.DecodePayload(&payload); err != nil || payload.RoomID == "" {
+		c.replyError(env.ID, ErrCodeInvalidPayload, "roomID is required")
+		return
+	}
+	if payload.Since != nil && *payload.Since < 0 {
+		c.replyError(env.ID, ErrCodeInvalidPayload, "since must not be negative")
+		return
+	}
+
+	if err := authorizeChatMember(c.DB, payload.RoomID, c.ID); err != nil {
+		log.Printf("User %s cannot subscribe to chat %s: %v", c.ID, payload.RoomID, err)
+		switch {
+		case errors.Is(err, errChatNotFound):
+			c.replyError(env.ID, ErrCodeNotFound, "Chat not found")
+		case errors.Is(err, errNotChatMember):
+			c.replyError(env.ID, ErrCodeForbidden, "User not a member of this chat")
+		default:
+			c.replyError(env.ID, ErrCodeInternal, "Internal server error")
+		}
+		return
+	}
+
+	if payload.Since == nil {
+		hub.Subscribe <- &Subscription{Client: c, RoomID: payload.RoomID}
+		c.ack(env.ID)
+		return
+	}
+
+	c.ack(env.ID)
+	if err := c.catchUp(hub, payload.RoomID, *payload.Since, c.queue); err != nil {
+		log.Printf("Error replaying chat %s to client %s: %v", payload.RoomID, c.ID, err)
+		c.replyError(env.ID, ErrCodeInternal, "Failed to replay missed messages")
+	}
+}
+
+// catchUp replays messages of a chat newer than since, subscribes the connection
+// and then replays anything stored while subscribing, so no message is missed
+// between the replay and live delivery. Messages stored during the subscription
+// may be delivered twice; clients deduplicate them by seq. A sync frame marks
+// the switch to live delivery.
+func (c *Client) catchUp(hub *Hub, roomID string, since int64, send func(*Envelope) error) error {
+	lastSeq, truncated, err := c.replay(roomID, since, maxReplayMessages, send)
+	if err != nil {
+		return err
+	}
+
+	hub.Subscribe <- &Subscription{Client: c, RoomID: roomID}
+
+	// Live frames now share the send buffer, and the hub closes connections
+	// whose buffer is full, so the second replay only takes half of the free
+	// space. Clients refetch whatever did not fit.
+	if !truncated {
+		lastSeq, truncated, err = c.replay(roomID, lastSeq, (cap(c.Send)-len(c.Send))/2, send)
+		if err != nil {
+			return err
 		}
+	}
+
+	env, err := NewEnvelope(FrameSync, "", SyncPayload{RoomID: roomID, Seq: lastSeq, Truncated: truncated})
+	if err != nil {
+		return err
+	}
+	return send(env)
+}
+
+// replay sends up to limit messages of a chat newer than since and returns the
+// last sequence number sent and whether more messages were left out.
+func (c *Client) replay(roomID string, since int64, limit int, send func(*Envelope) error) (int64, bool, error) {
+	messages, err := loadMessagesSince(c.DB, roomID, c.ID, since, limit+1)
+	if err != nil {
+		return since, false, err
+	}
+	truncated := len(messages) > limit
+	if truncated {
+		messages = messages[:limit]
+	}
 
-		// Save the message to the database
-		_, dbErr := c.DB.Exec(
-			"INSERT INTO messages (id, chat_id, sender_id, content, created_at) VALUES ($1, $2, $3, $4, $5)",
-			msg.ID, msg.RoomID, msg.SenderID, msg.Content, msg.CreatedAt,
-		)
-		if dbErr != nil {
-			log.Printf("Failed to save message from client %s to database: %v", c.ID, dbErr)
-		} else {
-			log.Printf("Message saved to database: %+v", msg)
+	lastSeq := since
+	for _, msg := range messages {
+		env, err := NewEnvelope(FrameMessage, msg.ID, msg)
+		if err != nil {
+			return lastSeq, false, err
+		}
+		if err := send(env); err != nil {
+			return lastSeq, false, err
 		}
+		lastSeq = msg.Seq
+	}
+
+	log.Printf("Replayed %d messages of chat %s to client %s", len(messages), roomID, c.ID)
+	return lastSeq, truncated, nil
+}
+
+// writeFrame writes a frame directly to the connection. It must only be used
+// before the writeMessage goroutine is started.
+func (c *Client) writeFrame(env *Envelope) error {
+	c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return c.Conn.WriteJSON(env)
+}
+
+// queue waits for room in the send buffer, failing if the client stalls.
+func (c *Client) queue(env *Envelope) error {
+	select {
+	case c.Send <- env:
+		return nil
+	case <-time.After(10 * time.Second):
+		return errors.New("timed out queueing frame")
+	}
+}
+
+// handleUnsubscribe stops delivery of a chat's frames to this connection.
+func (c *Client) handleUnsubscribe(hub *Hub, env *Envelope) {
+	var payload SubscriptionPayload
+	if err := env.DecodePayload(&payload); err != nil || payload.RoomID == "" {
+		c.replyError(env.ID, ErrCodeInvalidPayload, "roomID is required")
+		return
+	}
+
+	hub.Unsubscribe <- &Subscription{Client: c, RoomID: payload.RoomID}
+	c.ack(env.ID)
+}
+
+// ack acknowledges the frame with the given ID.
+func (c *Client) ack(id string) {
+	c.ackWith(id, AckPayload{ID: id})
+}
 
-		// Broadcast the message to other clients in the chat room
-		hub.Broadcast <- msg
+// ackWith acknowledges the frame with the given ID using a detailed payload.
+func (c *Client) ackWith(id string, payload AckPayload) {
+	env, err := NewEnvelope(FrameAck, id, payload)
+	if err != nil {
+		log.Printf("Failed to encode ack for client %s: %v", c.ID, err)
+		return
 	}
+	c.reply(env)
 }
 
 // StartHeartbeat starts a periodic ping to the WebSocket client to keep the connection alive.
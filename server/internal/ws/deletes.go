@@ -0,0 +1,146 @@
+package ws
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Deletion scopes accepted by DeleteMessage
+const (
+	deleteForMe       = "me"
+	deleteForEveryone = "everyone"
+)
+
+// DeleteMessage deletes a message. With ?for=everyone the sender or a chat admin
+// replaces it with a tombstone for all members and a delete event is pushed to
+// the chat; with ?for=me (the default) it is only hidden from the caller.
+func (h *Handler) DeleteMessage(c *gin.Context) {
+	messageID := c.Param("id")
+	userID := c.GetString("userID")
+	chatID := c.GetString("chatID")
+
+	switch c.DefaultQuery("for", deleteForMe) {
+	case deleteForMe:
+		h.hideMessage(c, messageID, userID)
+	case deleteForEveryone:
+		h.tombstoneMessage(c, messageID, chatID, userID)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "for must be either \"me\" or \"everyone\""})
+	}
+}
+
+// hideMessage removes a message from the user's own view of the chat.
+func (h *Handler) hideMessage(c *gin.Context, messageID, userID string) {
+	_, err := h.db.Exec(`
+		INSERT INTO hidden_messages (message_id, user_id)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`, messageID, userID)
+	if err != nil {
+		log.Printf("Error hiding message %s for user %s: %v", messageID, userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete message"})
+		return
+	}
+
+	log.Printf("Message %s deleted for user %s", messageID, userID)
+	c.JSON(http.StatusOK, gin.H{"id": messageID, "for": deleteForMe})
+}
+
+// tombstoneMessage clears a message's content and edit history for everyone.
+func (h *Handler) tombstoneMessage(c *gin.Context, messageID, chatID, userID string) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Locking the row makes concurrent deletions wait and then see deleted_at
+	var senderID, kind string
+	var deletedAt sql.NullTime
+	err = tx.QueryRow(`
+		SELECT sender_id, kind, deleted_at
+		FROM messages
+		WHERE id = $1
+		FOR UPDATE`, messageID).Scan(&senderID, &kind, &deletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading message %s for deletion: %v", messageID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	if kind == MessageKindSystem {
+		c.JSON(http.StatusForbidden, gin.H{"error": "System messages cannot be deleted for everyone"})
+		return
+	}
+	if senderID != userID {
+		isAdmin, err := isChatAdmin(h.db, chatID, userID)
+		if err != nil {
+			log.Printf("Error checking admin rights of user %s in chat %s: %v", userID, chatID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+		if !isAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the sender or a chat admin can delete this message for everyone"})
+			return
+		}
+	}
+
+	// Deleting twice is a no-op
+	if deletedAt.Valid {
+		c.JSON(http.StatusOK, gin.H{"id": messageID, "for": deleteForEveryone, "deletedAt": deletedAt.Time})
+		return
+	}
+
+	var deletedAtTime time.Time
+	err = tx.QueryRow(`
+		UPDATE messages SET content = '', deleted_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING deleted_at`, messageID).Scan(&deletedAtTime)
+	if err != nil {
+		log.Printf("Error deleting message %s: %v", messageID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete message"})
+		return
+	}
+
+	// Prior versions, reactions and mentions would otherwise outlive the content
+	for _, table := range []string{"message_edits", "message_reactions", "message_mentions"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE message_id = $1", messageID); err != nil {
+			log.Printf("Error deleting %s of message %s: %v", table, messageID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete message"})
+			return
+		}
+	}
+
+	keys, err := deleteAttachments(tx, messageID)
+	if err != nil {
+		log.Printf("Error deleting attachments of message %s: %v", messageID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete message"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing deletion of message %s: %v", messageID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	h.deleteStoredFiles(keys...)
+	log.Printf("Message %s deleted for everyone by user %s", messageID, userID)
+	h.hub.Publish(chatID, FrameDelete, DeletePayload{
+		MessageID: messageID,
+		RoomID:    chatID,
+		DeletedAt: deletedAtTime,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"id": messageID, "for": deleteForEveryone, "deletedAt": deletedAtTime})
+}
@@ -0,0 +1,180 @@
+package ws
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"server/config"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MessageEdit is a prior version of an edited message.
+type MessageEdit struct {
+	Content  string    `json:"content"`  // Content before the edit
+	EditedAt time.Time `json:"editedAt"` // When it was replaced
+}
+
+// EditMessage replaces the content of a message. Only the sender may edit, and
+// only within the configured edit window. The previous content is kept in
+// message_edits and an edit event is pushed to the chat. Mentions are parsed
+// again: members no longer mentioned are dropped and newly mentioned ones are
+// notified.
+func (h *Handler) EditMessage(c *gin.Context) {
+	messageID := c.Param("id")
+	userID := c.GetString("userID")
+
+	var req struct {
+		Content string `json:"content"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Content) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Message content is required"})
+		return
+	}
+	mentionedIDs, err := resolveMentions(h.users, req.Content)
+	if err != nil {
+		log.Printf("Error resolving mentions of message %s: %v", messageID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var senderID, chatID, kind, oldContent string
+	var ageSeconds float64
+	var deleted bool
+	err = tx.QueryRow(`
+		SELECT sender_id, chat_id, kind, content, EXTRACT(EPOCH FROM (CURRENT_TIMESTAMP - created_at)), deleted_at IS NOT NULL
+		FROM messages
+		WHERE id = $1
+		FOR UPDATE`, messageID).Scan(&senderID, &chatID, &kind, &oldContent, &ageSeconds, &deleted)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading message %s for edit: %v", messageID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	if kind == MessageKindSystem {
+		c.JSON(http.StatusForbidden, gin.H{"error": "System messages cannot be edited"})
+		return
+	}
+	if senderID != userID {
+		log.Printf("User %s tried to edit message %s sent by %s", userID, messageID, senderID)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the sender can edit this message"})
+		return
+	}
+
+	if deleted {
+		c.JSON(http.StatusConflict, gin.H{"error": "Message has been deleted"})
+		return
+	}
+
+	window := config.GetMessageEditWindow()
+	if window > 0 && time.Duration(ageSeconds*float64(time.Second)) > window {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Edit window has expired"})
+		return
+	}
+
+	if oldContent == req.Content {
+		c.JSON(http.StatusOK, gin.H{"id": messageID, "content": oldContent})
+		return
+	}
+
+	_, err = tx.Exec("INSERT INTO message_edits (message_id, content) VALUES ($1, $2)", messageID, oldContent)
+	if err != nil {
+		log.Printf("Error saving previous version of message %s: %v", messageID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to edit message"})
+		return
+	}
+
+	var editedAt time.Time
+	err = tx.QueryRow(`
+		UPDATE messages SET content = $2, edited_at = CURRENT_TIMESTAMP, link_urls = '{}'
+		WHERE id = $1
+		RETURNING edited_at`, messageID, req.Content).Scan(&editedAt)
+	if err != nil {
+		log.Printf("Error updating message %s: %v", messageID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to edit message"})
+		return
+	}
+
+	edited := &Message{ID: messageID, RoomID: chatID, SenderID: senderID, Kind: kind, Content: req.Content}
+	newMentions, err := updateMentions(tx, edited, mentionedIDs)
+	if err != nil {
+		log.Printf("Error updating mentions of message %s: %v", messageID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to edit message"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing edit of message %s: %v", messageID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	log.Printf("Message %s edited by user %s", messageID, userID)
+	h.hub.Publish(chatID, FrameEdit, EditPayload{
+		MessageID: messageID,
+		RoomID:    chatID,
+		Content:   req.Content,
+		EditedAt:  editedAt,
+		Mentions:  edited.Mentions,
+	})
+	h.hub.queueLinkPreviews(edited)
+	if len(newMentions) > 0 {
+		if msg, err := loadMessage(h.db, messageID, senderID); err != nil {
+			log.Printf("Error loading message %s to notify mentions: %v", messageID, err)
+		} else {
+			h.hub.notifyMentions(msg, newMentions)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":       messageID,
+		"content":  req.Content,
+		"editedAt": editedAt,
+	})
+}
+
+// GetMessageEdits returns the prior versions of a message, oldest first.
+func (h *Handler) GetMessageEdits(c *gin.Context) {
+	messageID := c.Param("id")
+
+	rows, err := h.db.Query(`
+		SELECT content, edited_at
+		FROM message_edits
+		WHERE message_id = $1
+		ORDER BY edited_at ASC`, messageID)
+	if err != nil {
+		log.Printf("Error fetching edits of message %s: %v", messageID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch message history"})
+		return
+	}
+	defer rows.Close()
+
+	edits := []MessageEdit{}
+	for rows.Next() {
+		var edit MessageEdit
+		if err := rows.Scan(&edit.Content, &edit.EditedAt); err != nil {
+			log.Printf("Error parsing edits of message %s: %v", messageID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse message history"})
+			return
+		}
+		edits = append(edits, edit)
+	}
+
+	c.JSON(http.StatusOK, edits)
+}
@@ -0,0 +1,680 @@
+package ws
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Member roles in a chat. Roles only grant rights in group chats.
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// Events reported in chat_event frames
+const (
+	ChatEventCreated       = "chat_created"
+	ChatEventRenamed       = "chat_renamed"
+	ChatEventAvatarChanged = "avatar_changed"
+	ChatEventMemberAdded   = "member_added"
+	ChatEventMemberRemoved = "member_removed"
+	ChatEventMemberLeft    = "member_left"
+	ChatEventRoleChanged   = "role_changed"
+	ChatEventOwnerChanged  = "owner_changed"
+)
+
+const (
+	maxChatNameLength  = 255
+	maxAvatarURLLength = 2048
+)
+
+var errNotGroupChat = errors.New("chat is not a group chat")
+
+// roleRank orders roles by the rights they grant.
+func roleRank(role string) int {
+	switch role {
+	case RoleOwner:
+		return 2
+	case RoleAdmin:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// GroupChat describes a group chat and its members' roles.
+type GroupChat struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	AvatarURL string            `json:"avatarURL,omitempty"`
+	Roles     map[string]string `json:"roles"` // Role per member user ID
+}
+
+// validateChatName trims the name and checks its length.
+func validateChatName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("Group name is required")
+	}
+	if utf8.RuneCountInString(name) > maxChatNameLength {
+		return "", fmt.Errorf("Group name must be at most %d characters", maxChatNameLength)
+	}
+	return name, nil
+}
+
+// validateAvatarURL accepts an empty value, which clears the avatar, or an
+// absolute http(s) URL.
+func validateAvatarURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", nil
+	}
+	if len(raw) > maxAvatarURLLength {
+		return "", fmt.Errorf("Avatar URL must be at most %d characters", maxAvatarURLLength)
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", errors.New("Avatar URL must be an http or https URL")
+	}
+	return raw, nil
+}
+
+// validUserIDs deduplicates the IDs, drops excludeID and rejects malformed ones.
+func validUserIDs(ids []string, excludeID string) ([]string, bool) {
+	ids = uniqueMembers(ids)
+	result := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, err := uuid.Parse(id); err != nil {
+			return nil, false
+		}
+		if id != excludeID {
+			result = append(result, id)
+		}
+	}
+	return result, true
+}
+
+// memberRole returns the user's role in a group chat. It returns
+// errNotGroupChat for one-on-one chats and errNotChatMember for non-members.
+func memberRole(db *sql.DB, chatID, userID string) (string, error) {
+	var isGroup bool
+	var role sql.NullString
+	err := db.QueryRow(`
+		SELECT c.is_group, cm.role
+		FROM chats c
+		LEFT JOIN chat_members cm ON cm.chat_id = c.id AND cm.user_id = $2
+		WHERE c.id = $1`, chatID, userID).Scan(&isGroup, &role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errChatNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to load member role: %w", err)
+	}
+	if !isGroup {
+		return "", errNotGroupChat
+	}
+	if !role.Valid {
+		return "", errNotChatMember
+	}
+	return role.String, nil
+}
+
+// requireGroupRole loads the caller's role and checks that it is at least
+// minRole. It writes the error response and returns false otherwise.
+func (h *Handler) requireGroupRole(c *gin.Context, chatID, userID, minRole string) (string, bool) {
+	role, err := memberRole(h.db, chatID, userID)
+	if errors.Is(err, errNotGroupChat) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Chat is not a group chat"})
+		return "", false
+	}
+	if err != nil {
+		log.Printf("Error loading role of user %s in chat %s: %v", userID, chatID, err)
+		respondChatAccessError(c, err)
+		return "", false
+	}
+	if roleRank(role) < roleRank(minRole) {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Only a group %s can do this", minRole)})
+		return "", false
+	}
+	return role, true
+}
+
+// commitWithSystemMessages records the events in the chat's history and commits tx.
+// It writes the error response and returns false on failure.
+func (h *Handler) commitWithSystemMessages(c *gin.Context, tx *sql.Tx, events []ChatEventPayload) ([]*Message, bool) {
+	messages := make([]*Message, 0, len(events))
+	for _, event := range events {
+		msg, err := saveSystemMessage(tx, event)
+		if err != nil {
+			log.Printf("Error recording chat event: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return nil, false
+		}
+		messages = append(messages, msg)
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return nil, false
+	}
+	return messages, true
+}
+
+// notifyUsers sends a chat_event frame to every connection of the given users,
+// whether or not they are subscribed to the chat.
+func (h *Handler) notifyUsers(userIDs []string, event ChatEventPayload) {
+	env, err := NewEnvelope(FrameChatEvent, "", event)
+	if err != nil {
+		log.Printf("Failed to encode %s event for chat %s: %v", event.Event, event.RoomID, err)
+		return
+	}
+	h.hub.sendToUsers(userIDs, env)
+}
+
+// CreateGroup creates a named group chat owned by the caller.
+func (h *Handler) CreateGroup(c *gin.Context) {
+	userID := c.GetString("userID")
+
+	var req struct {
+		Name      string   `json:"name"`
+		AvatarURL string   `json:"avatarURL"`
+		Members   []string `json:"members"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+		return
+	}
+
+	name, err := validateChatName(req.Name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	avatarURL, err := validateAvatarURL(req.AvatarURL)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	members, ok := validUserIDs(req.Members, userID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid member ID"})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	chatID := uuid.New().String()
+	_, err = tx.Exec(`
+		INSERT INTO chats (id, name, creator_id, is_group, avatar_url)
+		VALUES ($1, $2, $3, true, NULLIF($4, ''))`, chatID, name, userID, avatarURL)
+	if err != nil {
+		log.Printf("Error creating group chat: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create group"})
+		return
+	}
+
+	_, err = tx.Exec("INSERT INTO chat_members (chat_id, user_id, role) VALUES ($1, $2, $3)", chatID, userID, RoleOwner)
+	if err != nil {
+		log.Printf("Error adding owner to group %s: %v", chatID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create group"})
+		return
+	}
+
+	// Unknown user IDs are skipped
+	added, err := addGroupMembers(tx, chatID, members)
+	if err != nil {
+		log.Printf("Error adding members to group %s: %v", chatID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add members"})
+		return
+	}
+
+	event := ChatEventPayload{RoomID: chatID, Event: ChatEventCreated, ActorID: userID, Name: name, AvatarURL: avatarURL}
+	if _, err := saveSystemMessage(tx, event); err != nil {
+		log.Printf("Error recording creation of group %s: %v", chatID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create group"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	log.Printf("User %s created group %s with %d members", userID, chatID, len(added)+1)
+	// The creator's other connections learn about the group the same way
+	h.notifyUsers(append(added, userID), event)
+
+	roles := map[string]string{userID: RoleOwner}
+	for _, memberID := range added {
+		roles[memberID] = RoleMember
+	}
+	c.JSON(http.StatusCreated, GroupChat{ID: chatID, Name: name, AvatarURL: avatarURL, Roles: roles})
+}
+
+// addGroupMembers adds existing users to the chat as members and returns the
+// IDs of the users who were not members yet.
+func addGroupMembers(tx *sql.Tx, chatID string, userIDs []string) ([]string, error) {
+	added := []string{}
+	if len(userIDs) == 0 {
+		return added, nil
+	}
+
+	rows, err := tx.Query(`
+		INSERT INTO chat_members (chat_id, user_id, role)
+		SELECT $1, id, $3 FROM users WHERE id = ANY($2::uuid[])
+		ON CONFLICT (chat_id, user_id) DO NOTHING
+		RETURNING user_id`, chatID, pq.Array(userIDs), RoleMember)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		added = append(added, id)
+	}
+	return added, rows.Err()
+}
+
+// UpdateGroup renames a group or changes its avatar. Admins and the owner may
+// update a group; omitted fields are left unchanged.
+func (h *Handler) UpdateGroup(c *gin.Context) {
+	chatID := c.Param("chatID")
+	userID := c.GetString("userID")
+
+	var req struct {
+		Name      *string `json:"name"`
+		AvatarURL *string `json:"avatarURL"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Name == nil && req.AvatarURL == nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A name or avatarURL is required"})
+		return
+	}
+
+	var name, avatarURL string
+	var err error
+	if req.Name != nil {
+		if name, err = validateChatName(*req.Name); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.AvatarURL != nil {
+		if avatarURL, err = validateAvatarURL(*req.AvatarURL); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if _, ok := h.requireGroupRole(c, chatID, userID, RoleAdmin); !ok {
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var currentName string
+	var currentAvatar sql.NullString
+	err = tx.QueryRow(`
+		UPDATE chats
+		SET name = CASE WHEN $2 THEN $3 ELSE name END,
+			avatar_url = CASE WHEN $4 THEN NULLIF($5, '') ELSE avatar_url END
+		WHERE id = $1
+		RETURNING name, avatar_url`,
+		chatID, req.Name != nil, name, req.AvatarURL != nil, avatarURL).Scan(&currentName, &currentAvatar)
+	if err != nil {
+		log.Printf("Error updating group %s: %v", chatID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update group"})
+		return
+	}
+
+	var events []ChatEventPayload
+	if req.Name != nil {
+		events = append(events, ChatEventPayload{RoomID: chatID, Event: ChatEventRenamed, ActorID: userID, Name: name})
+	}
+	if req.AvatarURL != nil {
+		events = append(events, ChatEventPayload{RoomID: chatID, Event: ChatEventAvatarChanged, ActorID: userID, AvatarURL: avatarURL})
+	}
+	messages, ok := h.commitWithSystemMessages(c, tx, events)
+	if !ok {
+		return
+	}
+	h.broadcastSystemMessages(messages...)
+
+	c.JSON(http.StatusOK, gin.H{"id": chatID, "name": currentName, "avatarURL": currentAvatar.String})
+}
+
+// AddMembers adds users to a group. Admins and the owner may add members.
+func (h *Handler) AddMembers(c *gin.Context) {
+	chatID := c.Param("chatID")
+	userID := c.GetString("userID")
+
+	var req struct {
+		UserIDs []string `json:"userIDs"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.UserIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one user ID is required"})
+		return
+	}
+	userIDs, ok := validUserIDs(req.UserIDs, userID)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid member ID"})
+		return
+	}
+
+	if _, ok := h.requireGroupRole(c, chatID, userID, RoleAdmin); !ok {
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	added, err := addGroupMembers(tx, chatID, userIDs)
+	if err != nil {
+		log.Printf("Error adding members to group %s: %v", chatID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add members"})
+		return
+	}
+
+	events := make([]ChatEventPayload, len(added))
+	for i, memberID := range added {
+		events[i] = ChatEventPayload{RoomID: chatID, Event: ChatEventMemberAdded, ActorID: userID, TargetID: memberID}
+	}
+	messages, ok := h.commitWithSystemMessages(c, tx, events)
+	if !ok {
+		return
+	}
+
+	h.broadcastSystemMessages(messages...)
+	for _, event := range events {
+		h.notifyUsers([]string{event.TargetID}, event)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"added": added})
+}
+
+// RemoveMember removes another member from a group. The owner may remove
+// anyone else; admins may only remove plain members.
+func (h *Handler) RemoveMember(c *gin.Context) {
+	chatID := c.Param("chatID")
+	userID := c.GetString("userID")
+	targetID := c.Param("userID")
+
+	if targetID == userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Use leave to remove yourself from a group"})
+		return
+	}
+	if _, err := uuid.Parse(targetID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User is not a member of this group"})
+		return
+	}
+
+	role, ok := h.requireGroupRole(c, chatID, userID, RoleAdmin)
+	if !ok {
+		return
+	}
+
+	targetRole, err := memberRole(h.db, chatID, targetID)
+	if errors.Is(err, errNotChatMember) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User is not a member of this group"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading role of user %s in chat %s: %v", targetID, chatID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	if roleRank(targetRole) >= roleRank(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot remove a member with the same or a higher role"})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// The role condition guards against a concurrent promotion
+	result, err := tx.Exec("DELETE FROM chat_members WHERE chat_id = $1 AND user_id = $2 AND role = $3", chatID, targetID, targetRole)
+	if err != nil {
+		log.Printf("Error removing user %s from group %s: %v", targetID, chatID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member"})
+		return
+	}
+	if removed, _ := result.RowsAffected(); removed == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Membership changed, try again"})
+		return
+	}
+
+	messages, ok := h.commitWithSystemMessages(c, tx, []ChatEventPayload{
+		{RoomID: chatID, Event: ChatEventMemberRemoved, ActorID: userID, TargetID: targetID},
+	})
+	if !ok {
+		return
+	}
+
+	h.hub.RemoveMember(targetID, messages[0])
+	log.Printf("User %s removed user %s from group %s", userID, targetID, chatID)
+	c.JSON(http.StatusOK, gin.H{"removed": targetID})
+}
+
+// LeaveGroup removes the caller from a group. The owner has to transfer
+// ownership first unless they are the last member.
+func (h *Handler) LeaveGroup(c *gin.Context) {
+	chatID := c.Param("chatID")
+	userID := c.GetString("userID")
+
+	role, ok := h.requireGroupRole(c, chatID, userID, RoleMember)
+	if !ok {
+		return
+	}
+
+	if role == RoleOwner {
+		var others int
+		err := h.db.QueryRow("SELECT COUNT(*) FROM chat_members WHERE chat_id = $1 AND user_id != $2", chatID, userID).Scan(&others)
+		if err != nil {
+			log.Printf("Error counting members of group %s: %v", chatID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+		if others > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Transfer ownership before leaving the group"})
+			return
+		}
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM chat_members WHERE chat_id = $1 AND user_id = $2", chatID, userID); err != nil {
+		log.Printf("Error removing user %s from group %s: %v", userID, chatID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to leave group"})
+		return
+	}
+
+	messages, ok := h.commitWithSystemMessages(c, tx, []ChatEventPayload{
+		{RoomID: chatID, Event: ChatEventMemberLeft, ActorID: userID, TargetID: userID},
+	})
+	if !ok {
+		return
+	}
+
+	h.hub.RemoveMember(userID, messages[0])
+	log.Printf("User %s left group %s", userID, chatID)
+	c.JSON(http.StatusOK, gin.H{"left": chatID})
+}
+
+// TransferOwnership hands the group over to another member. The previous
+// owner stays in the group as an admin.
+func (h *Handler) TransferOwnership(c *gin.Context) {
+	chatID := c.Param("chatID")
+	userID := c.GetString("userID")
+
+	var req struct {
+		UserID string `json:"userID"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.UserID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "userID is required"})
+		return
+	}
+	if req.UserID == userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You already own this group"})
+		return
+	}
+	if _, err := uuid.Parse(req.UserID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User is not a member of this group"})
+		return
+	}
+
+	if _, ok := h.requireGroupRole(c, chatID, userID, RoleOwner); !ok {
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE chat_members SET role = $3 WHERE chat_id = $1 AND user_id = $2", chatID, req.UserID, RoleOwner)
+	if err != nil {
+		log.Printf("Error promoting user %s in group %s: %v", req.UserID, chatID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to transfer ownership"})
+		return
+	}
+	if promoted, _ := result.RowsAffected(); promoted == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User is not a member of this group"})
+		return
+	}
+
+	// The owner check guards against a concurrent transfer
+	result, err = tx.Exec("UPDATE chat_members SET role = $3 WHERE chat_id = $1 AND user_id = $2 AND role = $4", chatID, userID, RoleAdmin, RoleOwner)
+	if err != nil {
+		log.Printf("Error demoting user %s in group %s: %v", userID, chatID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to transfer ownership"})
+		return
+	}
+	if demoted, _ := result.RowsAffected(); demoted == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Membership changed, try again"})
+		return
+	}
+
+	messages, ok := h.commitWithSystemMessages(c, tx, []ChatEventPayload{
+		{RoomID: chatID, Event: ChatEventOwnerChanged, ActorID: userID, TargetID: req.UserID, Role: RoleOwner},
+	})
+	if !ok {
+		return
+	}
+
+	h.broadcastSystemMessages(messages...)
+	log.Printf("User %s transferred group %s to user %s", userID, chatID, req.UserID)
+	c.JSON(http.StatusOK, gin.H{"owner": req.UserID})
+}
+
+// SetMemberRole promotes a member to admin or demotes an admin. Only the
+// owner may change roles.
+func (h *Handler) SetMemberRole(c *gin.Context) {
+	chatID := c.Param("chatID")
+	userID := c.GetString("userID")
+	targetID := c.Param("userID")
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Role != RoleAdmin && req.Role != RoleMember) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be either \"admin\" or \"member\""})
+		return
+	}
+	if targetID == userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Transfer ownership to change your own role"})
+		return
+	}
+	if _, err := uuid.Parse(targetID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User is not a member of this group"})
+		return
+	}
+
+	if _, ok := h.requireGroupRole(c, chatID, userID, RoleOwner); !ok {
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var previous string
+	err = tx.QueryRow(`
+		UPDATE chat_members cm
+		SET role = $3
+		FROM chat_members old
+		WHERE cm.chat_id = $1 AND cm.user_id = $2 AND cm.role != $4
+			AND old.chat_id = cm.chat_id AND old.user_id = cm.user_id
+		RETURNING old.role`, chatID, targetID, req.Role, RoleOwner).Scan(&previous)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User is not a member of this group"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error changing role of user %s in group %s: %v", targetID, chatID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change role"})
+		return
+	}
+
+	var events []ChatEventPayload
+	if previous != req.Role {
+		events = append(events, ChatEventPayload{RoomID: chatID, Event: ChatEventRoleChanged, ActorID: userID, TargetID: targetID, Role: req.Role})
+	}
+	messages, ok := h.commitWithSystemMessages(c, tx, events)
+	if !ok {
+		return
+	}
+
+	h.broadcastSystemMessages(messages...)
+	c.JSON(http.StatusOK, gin.H{"userID": targetID, "role": req.Role})
+}
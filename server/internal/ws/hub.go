@@ -4,23 +4,60 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"server/internal/linkpreview"
 	"sync"
+	"time"
 )
 
 type Chat struct {
-	ID       string             `json:"id"`
-	Name     string             `json:"name,omitempty"`
-	Members  map[string]*Client `json:"members"`
-	Messages []*Message         `json:"messages"`
+	ID       string           `json:"id"`
+	Name     string           `json:"name,omitempty"`
+	Members  map[*Client]bool `json:"-"` // Connections subscribed to the chat
+	Messages []*Message       `json:"messages"`
+}
+
+// Event is a non-message frame fanned out to the connections subscribed to a chat.
+type Event struct {
+	RoomID        string
+	Frame         *Envelope
+	ExcludeUserID string // Optional user whose connections are skipped
+}
+
+// MemberRemoval drops a user from a chat they no longer belong to. Frame is
+// delivered to the chat, including the removed user, before they are unsubscribed.
+type MemberRemoval struct {
+	RoomID string
+	UserID string
+	Frame  *Envelope
+}
+
+// Subscription binds a client connection to a chat.
+type Subscription struct {
+	Client *Client
+	RoomID string
 }
 
 type Hub struct {
-	mu         sync.RWMutex        // Protects access to Chats
-	Chats      map[string]*Chat    // Active chats in the hub
-	Register   chan *Client        // Channel for registering new clients
-	Unregister chan *Client        // Channel for unregistering clients
-	Broadcast  chan *Message       // Channel for broadcasting messages
-	SyncChat   chan string         // Channel for synchronizing chats
+	mu          sync.RWMutex                // Protects access to Chats and Users
+	Chats       map[string]*Chat            // Active chats in the hub
+	Users       map[string]map[*Client]bool // Open connections per user ID
+	Register    chan *Client                // Channel for registering new connections
+	Unregister  chan *Client                // Channel for unregistering connections
+	Subscribe   chan *Subscription          // Channel for subscribing a connection to a chat
+	Unsubscribe chan *Subscription          // Channel for unsubscribing a connection from a chat
+	Broadcast   chan *Message               // Channel for broadcasting messages
+	Events      chan *Event                 // Channel for broadcasting other chat events
+	Removals    chan *MemberRemoval         // Channel for removing users from chats
+	Typing      chan *TypingUpdate          // Channel for typing indicator updates
+	Presence    chan *PresenceUpdate        // Channel for connection activity updates
+	SyncChat    chan string                 // Channel for synchronizing chats
+
+	typing          typingState          // Active typing indicators, owned by Run
+	presenceMu      sync.Mutex           // Protects pendingPresence
+	pendingPresence map[string]string    // Latest unpublished status per user ID
+	presenceReady   chan struct{}        // Wakes the presence worker when pendingPresence is not empty
+	previews        *linkpreview.Fetcher // Fetches link previews; nil disables them
+	previewQueue    chan linkPreviewJob  // Messages waiting for link previews
 }
 
 func LoadChatsIntoHub(h *Hub, db *sql.DB) error {
@@ -39,7 +76,7 @@ func LoadChatsIntoHub(h *Hub, db *sql.DB) error {
 		h.Chats[chatID] = &Chat{
 			ID:      chatID,
 			Name:    chatName,
-			Members: make(map[string]*Client),
+			Members: make(map[*Client]bool),
 		}
 		h.mu.Unlock()
 	}
@@ -48,60 +85,138 @@ func LoadChatsIntoHub(h *Hub, db *sql.DB) error {
 
 func NewHub() *Hub {
 	return &Hub{
-		Chats:      make(map[string]*Chat),
-		Register:   make(chan *Client),
-		Unregister: make(chan *Client),
-		Broadcast:  make(chan *Message, 5),
-		SyncChat:   make(chan string),
+		Chats:       make(map[string]*Chat),
+		Users:       make(map[string]map[*Client]bool),
+		Register:    make(chan *Client),
+		Unregister:  make(chan *Client),
+		Subscribe:   make(chan *Subscription),
+		Unsubscribe: make(chan *Subscription),
+		Broadcast:   make(chan *Message, 5),
+		Events:      make(chan *Event, 16),
+		Removals:    make(chan *MemberRemoval, 16),
+		Typing:      make(chan *TypingUpdate, 16),
+		Presence:    make(chan *PresenceUpdate, 16),
+		SyncChat:    make(chan string),
+
+		typing:          make(typingState),
+		pendingPresence: make(map[string]string),
+		presenceReady:   make(chan struct{}, 1),
+		previewQueue:    make(chan linkPreviewJob, 64),
 	}
 }
 
 func (h *Hub) Run(db *sql.DB) {
+	typingTicker := time.NewTicker(time.Second)
+	defer typingTicker.Stop()
+
+	go h.runPresenceWorker(db)
+	if h.previews != nil {
+		for i := 0; i < linkPreviewWorkers; i++ {
+			go h.runLinkPreviewWorker(db)
+		}
+	}
+
 	for {
 		select {
 		case client := <-h.Register:
 			h.mu.Lock()
-			if chat, exists := h.Chats[client.RoomID]; exists {
-				chat.Members[client.ID] = client
-				log.Printf("Client %s joined chat %s", client.ID, client.RoomID)
-			} else {
-				log.Printf("Chat %s not found for client %s", client.RoomID, client.ID)
+			before := h.userStatusLocked(client.ID)
+			if _, exists := h.Users[client.ID]; !exists {
+				h.Users[client.ID] = make(map[*Client]bool)
 			}
+			h.Users[client.ID][client] = true
+			connections := len(h.Users[client.ID])
+			after := h.userStatusLocked(client.ID)
 			h.mu.Unlock()
+			log.Printf("Client %s connected (%d open connections)", client.ID, connections)
+			h.notePresence(client.ID, before, after)
 
 		case client := <-h.Unregister:
 			h.mu.Lock()
-			if chat, exists := h.Chats[client.RoomID]; exists {
-				if _, exists := chat.Members[client.ID]; exists {
-					delete(chat.Members, client.ID)
-					close(client.Message)
-					log.Printf("Client %s left chat %s", client.ID, client.RoomID)
+			if conns, exists := h.Users[client.ID]; exists && conns[client] {
+				before := h.userStatusLocked(client.ID)
+				for _, roomID := range client.Rooms() {
+					h.removeFromChat(client, roomID)
+				}
+				delete(conns, client)
+				lastConnection := len(conns) == 0
+				if lastConnection {
+					delete(h.Users, client.ID)
 				}
-				if len(chat.Members) == 0 {
-					log.Printf("No members left in chat %s. Chat can be archived or removed.", chat.ID)
+				close(client.Send)
+				after := h.userStatusLocked(client.ID)
+				h.mu.Unlock()
+				log.Printf("Client %s disconnected", client.ID)
+
+				if lastConnection {
+					h.clearTyping(client.ID)
 				}
+				h.notePresence(client.ID, before, after)
+			} else {
+				h.mu.Unlock()
+			}
+
+		case sub := <-h.Subscribe:
+			h.mu.Lock()
+			chat, exists := h.Chats[sub.RoomID]
+			if !exists {
+				chat = &Chat{ID: sub.RoomID, Members: make(map[*Client]bool)}
+				h.Chats[sub.RoomID] = chat
 			}
+			chat.Members[sub.Client] = true
+			sub.Client.addRoom(sub.RoomID)
 			h.mu.Unlock()
+			log.Printf("Client %s subscribed to chat %s", sub.Client.ID, sub.RoomID)
+
+		case sub := <-h.Unsubscribe:
+			h.mu.Lock()
+			h.removeFromChat(sub.Client, sub.RoomID)
+			h.mu.Unlock()
+			log.Printf("Client %s unsubscribed from chat %s", sub.Client.ID, sub.RoomID)
 
 		case msg := <-h.Broadcast:
-			h.mu.RLock()
-			if chat, exists := h.Chats[msg.RoomID]; exists {
-				for _, client := range chat.Members {
-					select {
-					case client.Message <- msg:
-					default:
-						// Handle blocked message channels (e.g., disconnected clients)
-						close(client.Message)
-						h.mu.Lock()
-						delete(chat.Members, client.ID)
-						h.mu.Unlock()
-						log.Printf("Client %s disconnected from chat %s", client.ID, chat.ID)
-					}
-				}
-			} else {
-				log.Printf("Chat %s not found for message broadcast", msg.RoomID)
+			env, err := NewEnvelope(FrameMessage, msg.ID, msg)
+			if err != nil {
+				log.Printf("Failed to encode message %s for broadcast: %v", msg.ID, err)
+				continue
 			}
-			h.mu.RUnlock()
+			h.broadcastToChat(msg.RoomID, env, "")
+
+			// Sending a message ends the sender's typing indicator
+			if msg.Kind != MessageKindSystem {
+				h.applyTyping(&TypingUpdate{RoomID: msg.RoomID, UserID: msg.SenderID, Typing: false})
+				h.queueLinkPreviews(msg)
+			}
+			if len(msg.Mentions) > 0 {
+				h.notifyMentions(msg, msg.Mentions)
+			}
+
+		case event := <-h.Events:
+			h.broadcastToChat(event.RoomID, event.Frame, event.ExcludeUserID)
+
+		case removal := <-h.Removals:
+			h.broadcastToChat(removal.RoomID, removal.Frame, "")
+			h.mu.Lock()
+			for client := range h.Users[removal.UserID] {
+				h.removeFromChat(client, removal.RoomID)
+			}
+			h.mu.Unlock()
+			h.applyTyping(&TypingUpdate{RoomID: removal.RoomID, UserID: removal.UserID, Typing: false})
+			log.Printf("User %s removed from chat %s", removal.UserID, removal.RoomID)
+
+		case update := <-h.Typing:
+			h.applyTyping(update)
+
+		case update := <-h.Presence:
+			h.mu.Lock()
+			before := h.userStatusLocked(update.Client.ID)
+			update.Client.away = update.Status == StatusAway
+			after := h.userStatusLocked(update.Client.ID)
+			h.mu.Unlock()
+			h.notePresence(update.Client.ID, before, after)
+
+		case now := <-typingTicker.C:
+			h.expireTyping(now)
 
 		case chatID := <-h.SyncChat:
 			h.mu.Lock()
@@ -114,7 +229,7 @@ func (h *Hub) Run(db *sql.DB) {
 					h.Chats[chatID] = &Chat{
 						ID:      chatID,
 						Name:    chatName,
-						Members: make(map[string]*Client),
+						Members: make(map[*Client]bool),
 					}
 					log.Printf("Chat %s synchronized with hub", chatID)
 				}
@@ -123,3 +238,63 @@ func (h *Hub) Run(db *sql.DB) {
 		}
 	}
 }
+
+// Publish sends a frame of the given type to every connection subscribed to the chat.
+func (h *Hub) Publish(roomID string, frameType FrameType, payload interface{}) {
+	env, err := NewEnvelope(frameType, "", payload)
+	if err != nil {
+		log.Printf("Failed to encode %s event for chat %s: %v", frameType, roomID, err)
+		return
+	}
+	h.Events <- &Event{RoomID: roomID, Frame: env}
+}
+
+// RemoveMember broadcasts the system message announcing a user's removal and
+// then unsubscribes all of the user's connections from the chat.
+func (h *Hub) RemoveMember(userID string, msg *Message) {
+	env, err := NewEnvelope(FrameMessage, msg.ID, msg)
+	if err != nil {
+		log.Printf("Failed to encode message %s for broadcast: %v", msg.ID, err)
+		return
+	}
+	h.Removals <- &MemberRemoval{RoomID: msg.RoomID, UserID: userID, Frame: env}
+}
+
+// broadcastToChat queues a frame for every connection subscribed to the chat,
+// except those of excludeUserID when it is set. Connections that cannot keep
+// up are closed; their read loop then unregisters them.
+func (h *Hub) broadcastToChat(roomID string, env *Envelope, excludeUserID string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	chat, exists := h.Chats[roomID]
+	if !exists {
+		log.Printf("Chat %s not found for %s broadcast", roomID, env.Type)
+		return
+	}
+
+	for client := range chat.Members {
+		if excludeUserID != "" && client.ID == excludeUserID {
+			continue
+		}
+		select {
+		case client.Send <- env:
+		default:
+			log.Printf("Client %s is not keeping up, closing connection", client.ID)
+			client.Conn.Close()
+		}
+	}
+}
+
+// removeFromChat drops a connection from a chat. The caller must hold h.mu.
+func (h *Hub) removeFromChat(client *Client, roomID string) {
+	client.removeRoom(roomID)
+	chat, exists := h.Chats[roomID]
+	if !exists {
+		return
+	}
+	delete(chat.Members, client)
+	if len(chat.Members) == 0 {
+		log.Printf("No members left in chat %s. Chat can be archived or removed.", chat.ID)
+	}
+}
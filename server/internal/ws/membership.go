@@ -0,0 +1,146 @@
+package ws
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+var (
+	errChatNotFound    = errors.New("chat not found")
+	errNotChatMember   = errors.New("user not a member of this chat")
+	errMessageNotFound = errors.New("message not found")
+)
+
+// authorizeChatMember checks that the chat exists and that the user belongs to it.
+// It returns errChatNotFound or errNotChatMember when access must be denied.
+func authorizeChatMember(db *sql.DB, chatID, userID string) error {
+	if _, err := uuid.Parse(chatID); err != nil {
+		return errChatNotFound
+	}
+
+	var chatExists, isMember bool
+	err := db.QueryRow(`
+		SELECT
+			EXISTS (SELECT 1 FROM chats WHERE id = $1),
+			EXISTS (SELECT 1 FROM chat_members WHERE chat_id = $1 AND user_id = $2)`,
+		chatID, userID).Scan(&chatExists, &isMember)
+	if err != nil {
+		return fmt.Errorf("failed to check membership: %w", err)
+	}
+
+	if !chatExists {
+		return errChatNotFound
+	}
+	if !isMember {
+		return errNotChatMember
+	}
+	return nil
+}
+
+// respondChatAccessError writes the response for an authorizeChatMember error.
+func respondChatAccessError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errChatNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
+	case errors.Is(err, errMessageNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+	case errors.Is(err, errNotChatMember):
+		c.JSON(http.StatusForbidden, gin.H{"error": "User not a member of this chat"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+	}
+}
+
+// RequireChatMember rejects requests for chats the authenticated user does not belong to.
+// The chat is taken from the route parameter with the given name.
+func (h *Handler) RequireChatMember(param string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		chatID := c.Param(param)
+		userID := c.GetString("userID")
+		if userID == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			c.Abort()
+			return
+		}
+
+		if err := authorizeChatMember(h.db, chatID, userID); err != nil {
+			log.Printf("Access to chat %s denied for user %s: %v", chatID, userID, err)
+			respondChatAccessError(c, err)
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// authorizeMessageAccess checks that the message exists and that the user belongs
+// to its chat. It returns the chat the message was sent to.
+func authorizeMessageAccess(db *sql.DB, messageID, userID string) (string, error) {
+	if _, err := uuid.Parse(messageID); err != nil {
+		return "", errMessageNotFound
+	}
+
+	var chatID string
+	err := db.QueryRow("SELECT chat_id FROM messages WHERE id = $1", messageID).Scan(&chatID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errMessageNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to load message: %w", err)
+	}
+
+	// Non-members must not learn whether the message exists
+	if err := authorizeChatMember(db, chatID, userID); err != nil {
+		if errors.Is(err, errNotChatMember) {
+			return "", errMessageNotFound
+		}
+		return "", err
+	}
+	return chatID, nil
+}
+
+// RequireMessageAccess rejects requests for messages outside the authenticated
+// user's chats and stores the message's chat ID in the context as "chatID".
+func (h *Handler) RequireMessageAccess(param string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		messageID := c.Param(param)
+		userID := c.GetString("userID")
+		if userID == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			c.Abort()
+			return
+		}
+
+		chatID, err := authorizeMessageAccess(h.db, messageID, userID)
+		if err != nil {
+			log.Printf("Access to message %s denied for user %s: %v", messageID, userID, err)
+			respondChatAccessError(c, err)
+			c.Abort()
+			return
+		}
+
+		c.Set("chatID", chatID)
+		c.Next()
+	}
+}
+
+// isChatAdmin reports whether the user is the owner or an admin of a group chat.
+// One-on-one chats have no admins.
+func isChatAdmin(db *sql.DB, chatID, userID string) (bool, error) {
+	var isAdmin bool
+	err := db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM chat_members cm
+			JOIN chats c ON c.id = cm.chat_id
+			WHERE cm.chat_id = $1 AND cm.user_id = $2 AND c.is_group AND cm.role IN ($3, $4)
+		)`, chatID, userID, RoleOwner, RoleAdmin).Scan(&isAdmin)
+	return isAdmin, err
+}
@@ -0,0 +1,215 @@
+package ws
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"server/internal/user"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const (
+	maxMentionsPerMessage = 20 // Distinct usernames resolved per message
+	defaultMentionsLimit  = 20 // Mentions per page when no limit is given
+	maxMentionsLimit      = 50 // Server-side cap on the page size
+)
+
+// mentionPattern matches @username not preceded by a word character, so
+// email addresses are not taken for mentions.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_.@])@([\p{L}\p{N}_.\-]+)`)
+
+// MentionsPage is a page of messages mentioning the caller, newest first.
+type MentionsPage struct {
+	Messages   []Message `json:"messages"`
+	NextCursor string    `json:"nextCursor,omitempty"` // Cursor for the page of older mentions
+}
+
+// parseMentions returns the distinct usernames mentioned in content, in order
+// of appearance. Dots and dashes ending a mention are treated as punctuation.
+func parseMentions(content string) []string {
+	var usernames []string
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		username := strings.TrimRight(match[1], ".-")
+		if username == "" || seen[username] {
+			continue
+		}
+		if len(usernames) == maxMentionsPerMessage {
+			break
+		}
+		seen[username] = true
+		usernames = append(usernames, username)
+	}
+	return usernames
+}
+
+// resolveMentions looks up the users mentioned in content and returns their IDs.
+func resolveMentions(users user.Repository, content string) ([]string, error) {
+	usernames := parseMentions(content)
+	if users == nil || len(usernames) == 0 {
+		return nil, nil
+	}
+	found, err := users.GetUsersByUsernames(context.Background(), usernames)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve mentions: %w", err)
+	}
+	userIDs := make([]string, 0, len(found))
+	for _, u := range found {
+		userIDs = append(userIDs, u.ID)
+	}
+	return userIDs, nil
+}
+
+// saveMentions records the mentions of a message and sets msg.Mentions to the
+// members mentioned for the first time. Only members of the chat other than
+// the sender can be mentioned.
+func saveMentions(tx *sql.Tx, msg *Message, userIDs []string) error {
+	msg.Mentions = []string{}
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	rows, err := tx.Query(`
+		INSERT INTO message_mentions (message_id, user_id)
+		SELECT $1, cm.user_id
+		FROM chat_members cm
+		WHERE cm.chat_id = $2 AND cm.user_id = ANY($3::uuid[]) AND cm.user_id <> $4
+		ON CONFLICT DO NOTHING
+		RETURNING user_id`,
+		msg.ID, msg.RoomID, pq.Array(userIDs), msg.SenderID)
+	if err != nil {
+		return fmt.Errorf("failed to save mentions: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return fmt.Errorf("failed to scan mention: %w", err)
+		}
+		msg.Mentions = append(msg.Mentions, userID)
+	}
+	return rows.Err()
+}
+
+// updateMentions replaces the mentions of an edited message with userIDs and
+// sets msg.Mentions to all of them. It returns the members mentioned for the
+// first time, who have not been notified yet.
+func updateMentions(tx *sql.Tx, msg *Message, userIDs []string) ([]string, error) {
+	if userIDs == nil {
+		userIDs = []string{}
+	}
+	_, err := tx.Exec(`
+		DELETE FROM message_mentions
+		WHERE message_id = $1 AND user_id <> ALL($2::uuid[])`,
+		msg.ID, pq.Array(userIDs))
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove mentions: %w", err)
+	}
+	if err := saveMentions(tx, msg, userIDs); err != nil {
+		return nil, err
+	}
+
+	added := msg.Mentions
+	err = tx.QueryRow(`
+		SELECT COALESCE(array_agg(user_id::text), '{}')
+		FROM message_mentions
+		WHERE message_id = $1`, msg.ID).Scan(pq.Array(&msg.Mentions))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load mentions: %w", err)
+	}
+	return added, nil
+}
+
+// notifyMentions sends a mention frame carrying the message to every
+// connection of the given users, including chats they are not viewing.
+func (h *Hub) notifyMentions(msg *Message, userIDs []string) {
+	env, err := NewEnvelope(FrameMention, msg.ID, msg)
+	if err != nil {
+		log.Printf("Failed to encode mentions of message %s: %v", msg.ID, err)
+		return
+	}
+	h.sendToUsers(userIDs, env)
+}
+
+// GetMentions returns the messages mentioning the caller in chats they still
+// belong to, newest first. With unread=true only messages after the caller's
+// read cursor are returned. Pass the returned nextCursor as cursor to get the
+// next page.
+func (h *Handler) GetMentions(c *gin.Context) {
+	userID := c.GetString("userID")
+
+	args := []interface{}{userID}
+	conditions := []string{"m.deleted_at IS NULL", visibleTo("$1")}
+	if raw := c.Query("cursor"); raw != "" {
+		cursor, err := decodeMessageCursor(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		args = append(args, cursor.CreatedAt, cursor.ID)
+		conditions = append(conditions, "(m.created_at, m.id) < ($2::timestamp, $3::uuid)")
+	}
+	if unread, _ := strconv.ParseBool(c.Query("unread")); unread {
+		conditions = append(conditions, "m.seq > me.last_read_seq")
+	}
+
+	limit := defaultMentionsLimit
+	if raw := c.Query("limit"); raw != "" {
+		value, err := strconv.Atoi(raw)
+		if err != nil || value < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		limit = value
+	}
+	if limit > maxMentionsLimit {
+		limit = maxMentionsLimit
+	}
+	args = append(args, limit+1)
+
+	rows, err := h.db.Query(`
+		SELECT `+messageColumns("$1")+`
+		FROM `+messageTables+`
+		INNER JOIN message_mentions mm ON mm.message_id = m.id AND mm.user_id = $1
+		INNER JOIN chat_members me ON me.chat_id = m.chat_id AND me.user_id = $1
+		WHERE `+strings.Join(conditions, " AND ")+`
+		ORDER BY m.created_at DESC, m.id DESC
+		LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		log.Printf("Error loading mentions of user %s: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	defer rows.Close()
+
+	page := MentionsPage{Messages: []Message{}}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			log.Printf("Error loading mentions of user %s: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+		page.Messages = append(page.Messages, *msg)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error iterating mentions of user %s: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	if len(page.Messages) > limit {
+		page.Messages = page.Messages[:limit]
+		last := page.Messages[len(page.Messages)-1]
+		page.NextCursor = messageCursor{CreatedAt: last.CreatedAt, ID: last.ID}.encode()
+	}
+	c.JSON(http.StatusOK, page)
+}
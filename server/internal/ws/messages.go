@@ -0,0 +1,330 @@
+package ws
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"server/internal/user"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// maxClientMessageIDLength matches the size of messages.client_message_id.
+const maxClientMessageIDLength = 64
+
+var (
+	errEmptyMessage           = errors.New("message content or an attachment is required")
+	errClientMessageIDTooLong = fmt.Errorf("clientMessageID must be at most %d characters", maxClientMessageIDLength)
+	errInvalidReplyTarget     = errors.New("replyToID must reference a message in the same chat")
+)
+
+// QuotedMessage is a preview of the message a reply refers to.
+type QuotedMessage struct {
+	ID       string `json:"id"`
+	SenderID string `json:"senderID"`
+	Username string `json:"username"`
+	Content  string `json:"content"` // Empty when the quoted message was deleted
+	Deleted  bool   `json:"deleted,omitempty"`
+}
+
+// saveMessage inserts msg, links its AttachmentIDs, records the members it
+// mentions and fills in its ID, CreatedAt and Mentions. When the sender
+// already stored a message with the same ClientMessageID, the existing row is
+// loaded into msg instead and duplicate is true.
+func saveMessage(db *sql.DB, users user.Repository, msg *Message) (duplicate bool, err error) {
+	if strings.TrimSpace(msg.Content) == "" && len(msg.AttachmentIDs) == 0 {
+		return false, errEmptyMessage
+	}
+	if len(msg.ClientMessageID) > maxClientMessageIDLength {
+		return false, errClientMessageIDTooLong
+	}
+
+	var clientMessageID, replyToID sql.NullString
+	if msg.ClientMessageID != "" {
+		clientMessageID = sql.NullString{String: msg.ClientMessageID, Valid: true}
+	}
+	if msg.ReplyToID != "" {
+		quote, err := loadReplyTarget(db, msg.RoomID, msg.ReplyToID)
+		if err != nil {
+			return false, err
+		}
+		msg.ReplyTo = quote
+		replyToID = sql.NullString{String: msg.ReplyToID, Valid: true}
+	}
+	mentionedIDs, err := resolveMentions(users, msg.Content)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Bumping chats.last_seq locks the chat row, so sequence numbers are
+	// assigned in commit order within a chat.
+	err = tx.QueryRow(`
+		WITH next AS (
+			UPDATE chats SET last_seq = last_seq + 1 WHERE id = $1 RETURNING last_seq
+		)
+		INSERT INTO messages (chat_id, sender_id, content, client_message_id, reply_to_id, seq)
+		SELECT $1, $2, $3, $4, $5, last_seq FROM next
+		ON CONFLICT (sender_id, client_message_id) DO NOTHING
+		RETURNING id, seq, created_at`,
+		msg.RoomID, msg.SenderID, msg.Content, clientMessageID, replyToID,
+	).Scan(&msg.ID, &msg.Seq, &msg.CreatedAt)
+	msg.Kind = MessageKindUser
+	msg.Reactions = []Reaction{}
+	msg.SeenBy = []string{}
+	msg.Mentions = []string{}
+	if err == nil {
+		if err := linkAttachments(tx, msg); err != nil {
+			return false, err
+		}
+		if err := saveMentions(tx, msg, mentionedIDs); err != nil {
+			return false, err
+		}
+		if err := tx.Commit(); err != nil {
+			return false, fmt.Errorf("failed to save message: %w", err)
+		}
+		return false, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, fmt.Errorf("failed to save message: %w", err)
+	}
+	tx.Rollback()
+
+	// Without a ClientMessageID nothing can conflict, so the chat row is gone
+	if msg.ClientMessageID == "" {
+		return false, errChatNotFound
+	}
+
+	// The insert was skipped, so this is a retry of an already stored message
+	err = db.QueryRow(`
+		SELECT id, chat_id, content, COALESCE(reply_to_id::text, ''), seq, created_at
+		FROM messages
+		WHERE sender_id = $1 AND client_message_id = $2`,
+		msg.SenderID, msg.ClientMessageID,
+	).Scan(&msg.ID, &msg.RoomID, &msg.Content, &msg.ReplyToID, &msg.Seq, &msg.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, errChatNotFound
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to load deduplicated message: %w", err)
+	}
+	if msg.Attachments, err = loadAttachments(db, msg.ID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// loadReplyTarget validates that the replied-to message belongs to the chat and
+// returns its preview.
+func loadReplyTarget(db *sql.DB, chatID, replyToID string) (*QuotedMessage, error) {
+	if _, err := uuid.Parse(replyToID); err != nil {
+		return nil, errInvalidReplyTarget
+	}
+
+	quote := &QuotedMessage{ID: replyToID}
+	var parentChatID string
+	err := db.QueryRow(`
+		SELECT m.chat_id, m.sender_id, u.username, m.content, m.deleted_at IS NOT NULL
+		FROM messages m
+		INNER JOIN users u ON m.sender_id = u.id
+		WHERE m.id = $1`, replyToID,
+	).Scan(&parentChatID, &quote.SenderID, &quote.Username, &quote.Content, &quote.Deleted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errInvalidReplyTarget
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load reply target: %w", err)
+	}
+	if parentChatID != chatID {
+		return nil, errInvalidReplyTarget
+	}
+	return quote, nil
+}
+
+// isInvalidMessageError reports whether saveMessage rejected the message itself
+// rather than failing to store it.
+func isInvalidMessageError(err error) bool {
+	return errors.Is(err, errEmptyMessage) ||
+		errors.Is(err, errClientMessageIDTooLong) ||
+		errors.Is(err, errInvalidReplyTarget) ||
+		errors.Is(err, errInvalidAttachment)
+}
+
+// maxReplayMessages caps how many missed messages are replayed on reconnect.
+// Clients that fall further behind are told to refetch history over HTTP.
+const maxReplayMessages = 500
+
+// messageColumns lists the columns read by scanMessage, for queries FROM messageTables.
+// Per-viewer fields are computed for the user bound to viewerParam.
+func messageColumns(viewerParam string) string {
+	return `
+		m.id,
+		m.chat_id,
+		m.sender_id,
+		u.username,
+		m.kind,
+		m.content,
+		m.event,
+		m.seq,
+		m.created_at,
+		m.edited_at,
+		m.deleted_at,
+		m.reply_to_id,
+		pm.sender_id,
+		pu.username,
+		pm.content,
+		pm.deleted_at IS NOT NULL,
+		(SELECT COUNT(*) FROM messages r WHERE r.reply_to_id = m.id AND r.deleted_at IS NULL),
+		(
+			SELECT COALESCE(json_agg(json_build_object(
+				'emoji', g.emoji, 'count', g.count, 'reactedByMe', g.mine
+			) ORDER BY g.first_at), '[]')
+			FROM (
+				SELECT emoji, COUNT(*) AS count, BOOL_OR(user_id = ` + viewerParam + `) AS mine, MIN(created_at) AS first_at
+				FROM message_reactions
+				WHERE message_id = m.id
+				GROUP BY emoji
+			) g
+		),
+		(
+			SELECT COALESCE(json_agg(json_build_object(
+				'id', a.id, 'filename', a.filename, 'contentType', a.content_type, 'size', a.size
+			) ORDER BY a.created_at, a.id), '[]')
+			FROM attachments a
+			WHERE a.message_id = m.id
+		),
+		(
+			SELECT COALESCE(json_agg(json_build_object(
+				'url', lp.url, 'title', lp.title, 'description', lp.description,
+				'imageURL', lp.image_url, 'siteName', lp.site_name
+			) ORDER BY l.position), '[]')
+			FROM unnest(m.link_urls) WITH ORDINALITY AS l(url, position)
+			INNER JOIN link_previews lp ON lp.url = l.url AND NOT lp.failed
+			WHERE m.deleted_at IS NULL
+		),
+		(
+			SELECT COALESCE(array_agg(mm.user_id::text), '{}')
+			FROM message_mentions mm
+			WHERE mm.message_id = m.id
+		),
+		(
+			SELECT COALESCE(array_agg(cm.user_id::text), '{}')
+			FROM chat_members cm
+			WHERE cm.chat_id = m.chat_id AND cm.last_read_seq >= m.seq AND cm.user_id <> m.sender_id
+		)`
+}
+
+// messageTables joins messages m with their sender u and the replied-to message pm.
+const messageTables = `
+		messages m
+		INNER JOIN users u ON m.sender_id = u.id
+		LEFT JOIN messages pm ON pm.id = m.reply_to_id
+		LEFT JOIN users pu ON pu.id = pm.sender_id`
+
+// scanMessage reads a row selected with messageColumns.
+func scanMessage(rows *sql.Rows) (*Message, error) {
+	msg := &Message{}
+	var replyToID, quoteSenderID, quoteUsername, quoteContent sql.NullString
+	var quoteDeleted bool
+	var event, reactions, attachments, previews []byte
+	err := rows.Scan(
+		&msg.ID, &msg.RoomID, &msg.SenderID, &msg.Username, &msg.Kind, &msg.Content, &event, &msg.Seq, &msg.CreatedAt, &msg.EditedAt, &msg.DeletedAt,
+		&replyToID, &quoteSenderID, &quoteUsername, &quoteContent, &quoteDeleted, &msg.ReplyCount, &reactions, &attachments, &previews, pq.Array(&msg.Mentions), pq.Array(&msg.SeenBy),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan message: %w", err)
+	}
+	if err := json.Unmarshal(reactions, &msg.Reactions); err != nil {
+		return nil, fmt.Errorf("failed to decode reactions of message %s: %w", msg.ID, err)
+	}
+	if err := json.Unmarshal(attachments, &msg.Attachments); err != nil {
+		return nil, fmt.Errorf("failed to decode attachments of message %s: %w", msg.ID, err)
+	}
+	for i := range msg.Attachments {
+		msg.Attachments[i].URL = attachmentURL(msg.Attachments[i].ID)
+	}
+	if err := json.Unmarshal(previews, &msg.LinkPreviews); err != nil {
+		return nil, fmt.Errorf("failed to decode link previews of message %s: %w", msg.ID, err)
+	}
+	if event != nil {
+		msg.Event = &ChatEventPayload{}
+		if err := json.Unmarshal(event, msg.Event); err != nil {
+			return nil, fmt.Errorf("failed to decode event of message %s: %w", msg.ID, err)
+		}
+	}
+
+	if replyToID.Valid {
+		msg.ReplyToID = replyToID.String
+		msg.ReplyTo = &QuotedMessage{
+			ID:       replyToID.String,
+			SenderID: quoteSenderID.String,
+			Username: quoteUsername.String,
+			Content:  quoteContent.String,
+			Deleted:  quoteDeleted,
+		}
+	}
+	return msg, nil
+}
+
+// visibleTo filters out messages the viewer, bound to the given placeholder,
+// deleted for themselves.
+func visibleTo(viewerParam string) string {
+	return `
+		NOT EXISTS (
+			SELECT 1 FROM hidden_messages hm
+			WHERE hm.message_id = m.id AND hm.user_id = ` + viewerParam + `
+		)`
+}
+
+// loadMessage returns a message as seen by viewerID, or sql.ErrNoRows.
+func loadMessage(db *sql.DB, messageID, viewerID string) (*Message, error) {
+	rows, err := db.Query(`
+		SELECT `+messageColumns("$2")+`
+		FROM `+messageTables+`
+		WHERE m.id = $1`, messageID, viewerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load message %s: %w", messageID, err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to load message %s: %w", messageID, err)
+		}
+		return nil, sql.ErrNoRows
+	}
+	return scanMessage(rows)
+}
+
+// loadMessagesSince returns up to limit messages of a chat visible to viewerID
+// with a sequence number greater than since, in sequence order.
+func loadMessagesSince(db *sql.DB, chatID, viewerID string, since int64, limit int) ([]*Message, error) {
+	rows, err := db.Query(`
+		SELECT `+messageColumns("$4")+`
+		FROM `+messageTables+`
+		WHERE m.chat_id = $1 AND m.seq > $2 AND `+visibleTo("$4")+`
+		ORDER BY m.seq ASC
+		LIMIT $3`, chatID, since, limit, viewerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load messages since %d: %w", since, err)
+	}
+	defer rows.Close()
+
+	var messages []*Message
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
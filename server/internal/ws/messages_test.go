@@ -0,0 +1,282 @@
+package ws
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type fakeMessage struct {
+	id, chatID, senderID, content string
+	clientMessageID               driver.Value // nil when the sender set none
+	seq                           int64
+	createdAt                     time.Time
+}
+
+// fakeStore answers the message queries of this package from memory. Each
+// query is matched by a fragment of its text, and the fragments that guard
+// against conflicts must be present for the guard to apply.
+type fakeStore struct {
+	mu       sync.Mutex
+	lastSeq  map[string]int64 // Chat ID -> chats.last_seq
+	messages []*fakeMessage
+	readSeq  map[[2]string]int64 // Chat and user ID -> chat_members.last_read_seq
+}
+
+// addMessage stores a message as if it had been sent to the chat.
+func (s *fakeStore) addMessage(chatID, senderID, content string) *fakeMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSeq[chatID]++
+	msg := &fakeMessage{
+		id:        uuid.New().String(),
+		chatID:    chatID,
+		senderID:  senderID,
+		content:   content,
+		seq:       s.lastSeq[chatID],
+		createdAt: time.Now(),
+	}
+	s.messages = append(s.messages, msg)
+	return msg
+}
+
+func (s *fakeStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.messages)
+}
+
+func (s *fakeStore) query(query string, args []driver.Value) (driver.Rows, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case strings.Contains(query, "INSERT INTO messages"):
+		chatID, senderID, clientMessageID := args[0].(string), args[1].(string), args[3]
+		columns := []string{"id", "seq", "created_at"}
+		if _, exists := s.lastSeq[chatID]; !exists {
+			return &fakeRows{columns: columns}, nil
+		}
+		if clientMessageID != nil && s.findLocked(senderID, clientMessageID) != nil {
+			if strings.Contains(query, "ON CONFLICT (sender_id, client_message_id) DO NOTHING") {
+				return &fakeRows{columns: columns}, nil
+			}
+			return nil, errors.New("duplicate key value violates unique constraint")
+		}
+		s.lastSeq[chatID]++
+		msg := &fakeMessage{
+			id:              uuid.New().String(),
+			chatID:          chatID,
+			senderID:        senderID,
+			content:         args[2].(string),
+			clientMessageID: clientMessageID,
+			seq:             s.lastSeq[chatID],
+			createdAt:       time.Now(),
+		}
+		s.messages = append(s.messages, msg)
+		return &fakeRows{columns: columns, values: [][]driver.Value{{msg.id, msg.seq, msg.createdAt}}}, nil
+
+	case strings.Contains(query, "WHERE sender_id = $1 AND client_message_id = $2"):
+		rows := &fakeRows{columns: []string{"id", "chat_id", "content", "reply_to_id", "seq", "created_at"}}
+		if msg := s.findLocked(args[0].(string), args[1]); msg != nil {
+			rows.values = [][]driver.Value{{msg.id, msg.chatID, msg.content, "", msg.seq, msg.createdAt}}
+		}
+		return rows, nil
+
+	case strings.Contains(query, "FROM attachments"):
+		return &fakeRows{columns: []string{"id", "filename", "content_type", "size"}}, nil
+
+	case strings.Contains(query, "ORDER BY seq DESC LIMIT 1"):
+		rows := &fakeRows{columns: []string{"id", "seq"}}
+		for _, msg := range s.messages {
+			if msg.chatID == args[0] && (len(rows.values) == 0 || msg.seq > rows.values[0][1].(int64)) {
+				rows.values = [][]driver.Value{{msg.id, msg.seq}}
+			}
+		}
+		return rows, nil
+
+	case strings.Contains(query, "SELECT seq FROM messages WHERE id = $1 AND chat_id = $2"):
+		rows := &fakeRows{columns: []string{"seq"}}
+		for _, msg := range s.messages {
+			if msg.id == args[0] && msg.chatID == args[1] {
+				rows.values = [][]driver.Value{{msg.seq}}
+			}
+		}
+		return rows, nil
+
+	case strings.Contains(query, "UPDATE chat_members"):
+		member := [2]string{args[0].(string), args[1].(string)}
+		seq := args[3].(int64)
+		rows := &fakeRows{columns: []string{"last_read_at"}}
+		if current, exists := s.readSeq[member]; !exists ||
+			strings.Contains(query, "last_read_seq < $4") && current >= seq {
+			return rows, nil
+		}
+		s.readSeq[member] = seq
+		rows.values = [][]driver.Value{{time.Now()}}
+		return rows, nil
+
+	default:
+		return nil, fmt.Errorf("unexpected query: %s", query)
+	}
+}
+
+// findLocked returns the sender's message with the client message ID. The
+// caller must hold s.mu.
+func (s *fakeStore) findLocked(senderID string, clientMessageID driver.Value) *fakeMessage {
+	for _, msg := range s.messages {
+		if msg.senderID == senderID && msg.clientMessageID == clientMessageID {
+			return msg
+		}
+	}
+	return nil
+}
+
+func (s *fakeStore) Open(string) (driver.Conn, error) { return &fakeConn{store: s}, nil }
+
+type fakeConn struct{ store *fakeStore }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{store: c.store, query: query}, nil
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+// fakeTx applies every statement immediately; the tests do not need rollbacks.
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	store *fakeStore
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+func (s *fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("exec not supported")
+}
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.store.query(s.query, args)
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+var (
+	registerOnce sync.Once
+	fakeStores   sync.Map // Data source name -> *fakeStore
+)
+
+// fakeDriver opens the fake store registered under the data source name.
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	store, ok := fakeStores.Load(name)
+	if !ok {
+		return nil, fmt.Errorf("no fake store named %q", name)
+	}
+	return store.(*fakeStore).Open(name)
+}
+
+// newTestDB returns a database backed by an empty fake store with the given chats.
+func newTestDB(t *testing.T, chatIDs ...string) (*sql.DB, *fakeStore) {
+	t.Helper()
+	registerOnce.Do(func() { sql.Register("fakemessages", fakeDriver{}) })
+
+	store := &fakeStore{lastSeq: make(map[string]int64), readSeq: make(map[[2]string]int64)}
+	for _, chatID := range chatIDs {
+		store.lastSeq[chatID] = 0
+	}
+	fakeStores.Store(t.Name(), store)
+	db, err := sql.Open("fakemessages", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		fakeStores.Delete(t.Name())
+	})
+	return db, store
+}
+
+func TestSaveMessageDeduplicatesRetries(t *testing.T) {
+	db, store := newTestDB(t, "chat")
+
+	original := &Message{RoomID: "chat", SenderID: "alice", ClientMessageID: "c1", Content: "hello"}
+	duplicate, err := saveMessage(db, nil, original)
+	if err != nil || duplicate {
+		t.Fatalf("first send: duplicate = %v, err = %v", duplicate, err)
+	}
+	if original.ID == "" || original.Seq != 1 {
+		t.Fatalf("first send: ID = %q, seq = %d", original.ID, original.Seq)
+	}
+	if _, err := saveMessage(db, nil, &Message{RoomID: "chat", SenderID: "alice", Content: "no key"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A retry after a reconnect gets the stored message back, not its own content
+	retry := &Message{RoomID: "chat", SenderID: "alice", ClientMessageID: "c1", Content: "hello again"}
+	duplicate, err = saveMessage(db, nil, retry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !duplicate {
+		t.Error("retry was not reported as a duplicate")
+	}
+	if retry.ID != original.ID || retry.Seq != original.Seq || !retry.CreatedAt.Equal(original.CreatedAt) || retry.Content != "hello" {
+		t.Errorf("retry = %+v, want the original message %+v", retry, original)
+	}
+	if retry.Attachments == nil {
+		t.Error("attachments of the duplicate were not loaded")
+	}
+
+	// Client message IDs are only unique per sender
+	other := &Message{RoomID: "chat", SenderID: "bob", ClientMessageID: "c1", Content: "hi"}
+	if duplicate, err := saveMessage(db, nil, other); err != nil || duplicate {
+		t.Fatalf("other sender: duplicate = %v, err = %v", duplicate, err)
+	}
+	if other.ID == original.ID || other.Seq != 3 {
+		t.Errorf("other sender: ID = %q, seq = %d, want a new message with seq 3", other.ID, other.Seq)
+	}
+	if n := store.count(); n != 3 {
+		t.Errorf("stored %d messages, want 3", n)
+	}
+}
+
+func TestSaveMessageReportsMissingChat(t *testing.T) {
+	db, store := newTestDB(t, "chat")
+
+	for _, clientMessageID := range []string{"", "c1"} {
+		msg := &Message{RoomID: "gone", SenderID: "alice", ClientMessageID: clientMessageID, Content: "hello"}
+		if _, err := saveMessage(db, nil, msg); !errors.Is(err, errChatNotFound) {
+			t.Errorf("client message ID %q: err = %v, want %v", clientMessageID, err, errChatNotFound)
+		}
+	}
+	if n := store.count(); n != 0 {
+		t.Errorf("stored %d messages, want none", n)
+	}
+}
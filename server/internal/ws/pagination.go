@@ -0,0 +1,116 @@
+package ws
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultPageLimit = 50  // Messages per page when no limit is given
+	maxPageLimit     = 100 // Server-side cap on the page size
+)
+
+// PageQuery selects a page of messages by sequence number.
+type PageQuery struct {
+	Before *int64 // Only messages with a smaller seq
+	After  *int64 // Only messages with a greater seq
+	Limit  int
+}
+
+// MessagePage is a page of messages with the cursors for its neighbours.
+type MessagePage struct {
+	Messages []Message `json:"messages"`
+	HasMore  bool      `json:"hasMore"`          // More messages exist past this page in the requested direction
+	Before   *int64    `json:"before,omitempty"` // Cursor for the page of older messages
+	After    *int64    `json:"after,omitempty"`  // Cursor for the page of newer messages
+}
+
+// parsePageQuery reads the before, after and limit query parameters.
+func parsePageQuery(c *gin.Context) (PageQuery, error) {
+	query := PageQuery{Limit: defaultPageLimit}
+
+	for name, dst := range map[string]**int64{"before": &query.Before, "after": &query.After} {
+		raw := c.Query(name)
+		if raw == "" {
+			continue
+		}
+		value, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || value < 0 {
+			return query, fmt.Errorf("invalid %s cursor", name)
+		}
+		*dst = &value
+	}
+	if query.Before != nil && query.After != nil {
+		return query, errors.New("before and after cannot be combined")
+	}
+
+	if raw := c.Query("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 {
+			return query, errors.New("invalid limit")
+		}
+		query.Limit = limit
+	}
+	if query.Limit > maxPageLimit {
+		query.Limit = maxPageLimit
+	}
+	return query, nil
+}
+
+// loadMessagePage fetches one page of a chat's messages visible to viewerID, oldest first.
+// One extra row is requested to find out whether more messages exist.
+func loadMessagePage(db *sql.DB, chatID, viewerID string, query PageQuery) (*MessagePage, error) {
+	condition, order, cursor := "m.seq < $2", "DESC", int64(1<<63-1)
+	switch {
+	case query.After != nil:
+		condition, order, cursor = "m.seq > $2", "ASC", *query.After
+	case query.Before != nil:
+		cursor = *query.Before
+	}
+
+	rows, err := db.Query(`
+		SELECT `+messageColumns("$4")+`
+		FROM `+messageTables+`
+		WHERE m.chat_id = $1 AND `+condition+` AND `+visibleTo("$4")+`
+		ORDER BY m.seq `+order+`
+		LIMIT $3`, chatID, cursor, query.Limit+1, viewerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, *msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate messages: %w", err)
+	}
+
+	page := &MessagePage{HasMore: len(messages) > query.Limit}
+	if page.HasMore {
+		messages = messages[:query.Limit]
+	}
+
+	// Pages are always returned oldest first
+	if order == "DESC" {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+	page.Messages = messages
+
+	if len(messages) > 0 {
+		oldest, newest := messages[0].Seq, messages[len(messages)-1].Seq
+		page.Before, page.After = &oldest, &newest
+	}
+	return page, nil
+}
@@ -0,0 +1,215 @@
+package ws
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Presence statuses of a user across all of their connections
+const (
+	StatusOnline  = "online"  // At least one connection is active
+	StatusAway    = "away"    // Connected, but every connection reported away
+	StatusOffline = "offline" // No open connections
+)
+
+const (
+	maxPresenceIDs   = 100         // Users looked up in one presence request
+	presenceInterval = time.Second // Minimum time between presence frames of a connection
+)
+
+// PresenceUpdate reports that a connection became active or away.
+type PresenceUpdate struct {
+	Client *Client
+	Status string // StatusOnline or StatusAway
+}
+
+// UserPresence is a user's current status and when they were last seen.
+type UserPresence struct {
+	UserID     string     `json:"userID"`
+	Status     string     `json:"status"`
+	LastSeenAt *time.Time `json:"lastSeenAt,omitempty"`
+}
+
+// userStatusLocked derives a user's status from their connections. The caller must hold h.mu.
+func (h *Hub) userStatusLocked(userID string) string {
+	conns := h.Users[userID]
+	if len(conns) == 0 {
+		return StatusOffline
+	}
+	for client := range conns {
+		if !client.away {
+			return StatusOnline
+		}
+	}
+	return StatusAway
+}
+
+// UserStatus returns a user's current presence status.
+func (h *Hub) UserStatus(userID string) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.userStatusLocked(userID)
+}
+
+// notePresence records a status change for the presence worker when status
+// differs from before. It never blocks: changes of a user that are still
+// pending are merged, so only their latest status is published.
+func (h *Hub) notePresence(userID, before, after string) {
+	if before == after {
+		return
+	}
+	log.Printf("User %s is now %s", userID, after)
+
+	h.presenceMu.Lock()
+	h.pendingPresence[userID] = after
+	h.presenceMu.Unlock()
+
+	select {
+	case h.presenceReady <- struct{}{}:
+	default: // The worker has already been woken up
+	}
+}
+
+// runPresenceWorker persists last_seen_at and notifies everyone sharing a chat
+// with the user of their latest status.
+func (h *Hub) runPresenceWorker(db *sql.DB) {
+	for range h.presenceReady {
+		h.presenceMu.Lock()
+		pending := h.pendingPresence
+		h.pendingPresence = make(map[string]string)
+		h.presenceMu.Unlock()
+
+		for userID, status := range pending {
+			h.publishPresence(db, userID, status)
+		}
+	}
+}
+
+// publishPresence persists a user's last_seen_at and sends their status to
+// everyone sharing a chat with them.
+func (h *Hub) publishPresence(db *sql.DB, userID, status string) {
+	var lastSeenAt time.Time
+	err := db.QueryRow("UPDATE users SET last_seen_at = CURRENT_TIMESTAMP WHERE id = $1 RETURNING last_seen_at", userID).
+		Scan(&lastSeenAt)
+	if err != nil {
+		log.Printf("Failed to update last seen time of user %s: %v", userID, err)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT DISTINCT other.user_id
+		FROM chat_members mine
+		INNER JOIN chat_members other ON other.chat_id = mine.chat_id
+		WHERE mine.user_id = $1`, userID)
+	if err != nil {
+		log.Printf("Failed to load contacts of user %s: %v", userID, err)
+		return
+	}
+	var recipients []string
+	for rows.Next() {
+		var recipient string
+		if err := rows.Scan(&recipient); err == nil {
+			recipients = append(recipients, recipient)
+		}
+	}
+	rows.Close()
+
+	env, err := NewEnvelope(FramePresence, "", PresencePayload{
+		UserID:     userID,
+		Status:     status,
+		LastSeenAt: &lastSeenAt,
+	})
+	if err != nil {
+		log.Printf("Failed to encode presence of user %s: %v", userID, err)
+		return
+	}
+	h.sendToUsers(recipients, env)
+}
+
+// sendToUsers queues a frame for every open connection of the given users.
+func (h *Hub) sendToUsers(userIDs []string, env *Envelope) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, userID := range userIDs {
+		for client := range h.Users[userID] {
+			select {
+			case client.Send <- env:
+			default:
+				log.Printf("Client %s is not keeping up, closing connection", client.ID)
+				client.Conn.Close()
+			}
+		}
+	}
+}
+
+// handlePresence records that this connection became active or away. A
+// connection may report its presence at most once per presenceInterval.
+func (c *Client) handlePresence(hub *Hub, env *Envelope) {
+	var payload PresencePayload
+	if err := env.DecodePayload(&payload); err != nil || (payload.Status != StatusOnline && payload.Status != StatusAway) {
+		c.replyError(env.ID, ErrCodeInvalidPayload, "status must be \"online\" or \"away\"")
+		return
+	}
+	if time.Since(c.lastPresenceAt) < presenceInterval {
+		c.replyError(env.ID, ErrCodeRateLimited, "presence updated too often")
+		return
+	}
+	c.lastPresenceAt = time.Now()
+
+	hub.Presence <- &PresenceUpdate{Client: c, Status: payload.Status}
+	c.ack(env.ID)
+}
+
+// GetPresence returns the presence of the users listed in ?ids=, comma separated.
+func (h *Handler) GetPresence(c *gin.Context) {
+	var ids []string
+	for _, id := range strings.Split(c.Query("ids"), ",") {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		if _, err := uuid.Parse(id); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID: " + id})
+			return
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Query parameter ids is required"})
+		return
+	}
+	if len(ids) > maxPresenceIDs {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many user IDs"})
+		return
+	}
+
+	rows, err := h.db.Query("SELECT id, last_seen_at FROM users WHERE id = ANY($1::uuid[])", pq.Array(ids))
+	if err != nil {
+		log.Printf("Error fetching presence: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch presence"})
+		return
+	}
+	defer rows.Close()
+
+	presence := []UserPresence{}
+	for rows.Next() {
+		var p UserPresence
+		if err := rows.Scan(&p.UserID, &p.LastSeenAt); err != nil {
+			log.Printf("Error parsing presence: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse presence"})
+			return
+		}
+		p.Status = h.hub.UserStatus(p.UserID)
+		presence = append(presence, p)
+	}
+
+	c.JSON(http.StatusOK, presence)
+}
@@ -0,0 +1,142 @@
+package ws
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"server/internal/linkpreview"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// LinkPreview is the preview of a page linked in a message.
+type LinkPreview = linkpreview.Preview
+
+const (
+	maxLinkPreviews      = 3              // Links previewed per message
+	linkPreviewWorkers   = 4              // Pages fetched concurrently
+	linkPreviewTTL       = 24 * time.Hour // How long a fetched preview is reused
+	failedLinkPreviewTTL = time.Hour      // How long a page that could not be previewed is not retried
+)
+
+// linkPreviewJob asks for the previews of the links in a message.
+type linkPreviewJob struct {
+	messageID string
+	roomID    string
+	content   string // Content the links were found in
+	urls      []string
+}
+
+// EnableLinkPreviews makes the hub fetch previews of links in new and edited
+// messages with the given fetcher. It must be called before Run.
+func (h *Hub) EnableLinkPreviews(fetcher *linkpreview.Fetcher) {
+	h.previews = fetcher
+}
+
+// queueLinkPreviews schedules fetching the previews of the links in a message.
+// It never blocks: when the queue is full, the message goes without previews.
+func (h *Hub) queueLinkPreviews(msg *Message) {
+	if h.previews == nil || msg.Kind == MessageKindSystem {
+		return
+	}
+	urls := linkpreview.ExtractURLs(msg.Content, maxLinkPreviews)
+	if len(urls) == 0 {
+		return
+	}
+
+	select {
+	case h.previewQueue <- linkPreviewJob{messageID: msg.ID, roomID: msg.RoomID, content: msg.Content, urls: urls}:
+	default:
+		log.Printf("Link preview queue full, skipping previews of message %s", msg.ID)
+	}
+}
+
+// runLinkPreviewWorker resolves queued previews, records the links of each
+// message and pushes the previews to its chat.
+func (h *Hub) runLinkPreviewWorker(db *sql.DB) {
+	for job := range h.previewQueue {
+		previews := make([]LinkPreview, 0, len(job.urls))
+		for _, url := range job.urls {
+			preview, err := h.linkPreview(db, url)
+			if err != nil {
+				log.Printf("Failed to load link preview of %s: %v", url, err)
+				continue
+			}
+			if preview != nil {
+				previews = append(previews, *preview)
+			}
+		}
+
+		// The message may have been edited or deleted while the pages were fetched
+		result, err := db.Exec(`
+			UPDATE messages SET link_urls = $2
+			WHERE id = $1 AND content = $3 AND deleted_at IS NULL`,
+			job.messageID, pq.Array(job.urls), job.content)
+		if err != nil {
+			log.Printf("Failed to save links of message %s: %v", job.messageID, err)
+			continue
+		}
+		if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+			continue
+		}
+
+		h.Publish(job.roomID, FrameLinkPreview, LinkPreviewPayload{
+			MessageID: job.messageID,
+			RoomID:    job.roomID,
+			Previews:  previews,
+		})
+	}
+}
+
+// linkPreview returns the preview of a page, fetching it when the cached copy
+// is missing or stale. It returns nil when the page cannot be previewed.
+func (h *Hub) linkPreview(db *sql.DB, url string) (*LinkPreview, error) {
+	preview := &LinkPreview{URL: url}
+	var failed bool
+	var ageSeconds float64
+	err := db.QueryRow(`
+		SELECT title, description, image_url, site_name, failed, EXTRACT(EPOCH FROM (CURRENT_TIMESTAMP - fetched_at))
+		FROM link_previews
+		WHERE url = $1`, url).
+		Scan(&preview.Title, &preview.Description, &preview.ImageURL, &preview.SiteName, &failed, &ageSeconds)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to load cached preview: %w", err)
+	}
+	if err == nil {
+		age := time.Duration(ageSeconds * float64(time.Second))
+		switch {
+		case failed && age < failedLinkPreviewTTL:
+			return nil, nil
+		case !failed && age < linkPreviewTTL:
+			return preview, nil
+		}
+	}
+
+	fetched, fetchErr := h.previews.Fetch(context.Background(), url)
+	if fetchErr != nil {
+		log.Printf("Could not preview %s: %v", url, fetchErr)
+		fetched = &LinkPreview{URL: url}
+	}
+	_, err = db.Exec(`
+		INSERT INTO link_previews (url, title, description, image_url, site_name, failed)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (url) DO UPDATE SET
+			title = EXCLUDED.title,
+			description = EXCLUDED.description,
+			image_url = EXCLUDED.image_url,
+			site_name = EXCLUDED.site_name,
+			failed = EXCLUDED.failed,
+			fetched_at = CURRENT_TIMESTAMP`,
+		url, fetched.Title, fetched.Description, fetched.ImageURL, fetched.SiteName, fetchErr != nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cache preview: %w", err)
+	}
+
+	if fetchErr != nil {
+		return nil, nil
+	}
+	return fetched, nil
+}
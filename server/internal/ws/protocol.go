@@ -0,0 +1,218 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ProtocolVersion is the current version of the WebSocket envelope format.
+// Frames without a version are treated as the current version.
+const ProtocolVersion = 1
+
+// FrameType identifies the kind of payload carried by an Envelope.
+type FrameType string
+
+const (
+	FrameMessage  FrameType = "message"  // Chat message (client -> server and server -> client)
+	FrameTyping   FrameType = "typing"   // Typing indicator (server -> client)
+	FrameAck      FrameType = "ack"      // Server acknowledgement of a client frame
+	FrameError    FrameType = "error"    // Server error in response to a client frame
+	FramePresence FrameType = "presence" // Presence change of a user
+
+	FrameSubscribe   FrameType = "subscribe"    // Start receiving frames for a chat
+	FrameUnsubscribe FrameType = "unsubscribe"  // Stop receiving frames for a chat
+	FrameSync        FrameType = "sync"         // Replay of missed messages finished
+	FrameEdit        FrameType = "edit"         // A message was edited
+	FrameDelete      FrameType = "delete"       // A message was deleted for everyone
+	FrameReaction    FrameType = "reaction"     // A reaction was added or removed
+	FrameRead        FrameType = "read"         // A member's read cursor advanced
+	FrameTypingStart FrameType = "typing_start" // The user started or keeps typing (client -> server)
+	FrameTypingStop  FrameType = "typing_stop"  // The user stopped typing (client -> server)
+	FrameChatEvent   FrameType = "chat_event"   // The user was added to a chat they are not subscribed to yet
+	FrameLinkPreview FrameType = "link_preview" // Link previews of a message are ready
+	FrameMention     FrameType = "mention"      // The user was mentioned; the payload is the message
+)
+
+// Error codes sent in error frames
+const (
+	ErrCodeMalformedFrame     = "malformed_frame"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeInvalidPayload     = "invalid_payload"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeNotSubscribed      = "not_subscribed"
+	ErrCodeRateLimited        = "rate_limited"
+	ErrCodeInternal           = "internal_error"
+)
+
+// Envelope wraps every frame sent over the chat WebSocket.
+type Envelope struct {
+	Version int             `json:"v"`                 // Protocol version
+	Type    FrameType       `json:"type"`              // Frame type
+	ID      string          `json:"id,omitempty"`      // Frame ID, echoed back in acks and errors
+	Payload json.RawMessage `json:"payload,omitempty"` // Type-specific payload
+}
+
+// MessagePayload is the payload of an inbound message frame.
+type MessagePayload struct {
+	RoomID          string   `json:"roomID,omitempty"`          // Target chat; defaults to the connection's chat
+	ClientMessageID string   `json:"clientMessageID,omitempty"` // Idempotency key; defaults to the frame ID
+	ReplyToID       string   `json:"replyToID,omitempty"`       // Message being replied to
+	Content         string   `json:"content"`
+	AttachmentIDs   []string `json:"attachmentIDs,omitempty"` // Uploaded attachments to send with the message
+}
+
+// SubscriptionPayload is the payload of subscribe and unsubscribe frames.
+type SubscriptionPayload struct {
+	RoomID string `json:"roomID"`
+	Since  *int64 `json:"since,omitempty"` // Replay messages with a greater seq before live delivery
+}
+
+// SyncPayload is the payload of a sync frame.
+type SyncPayload struct {
+	RoomID    string `json:"roomID"`
+	Seq       int64  `json:"seq"`                 // Last replayed sequence number
+	Truncated bool   `json:"truncated,omitempty"` // More messages are missing; refetch history
+}
+
+// TypingPayload is the payload of a typing frame.
+type TypingPayload struct {
+	RoomID   string `json:"roomID"`
+	UserID   string `json:"userID,omitempty"`
+	Username string `json:"username,omitempty"`
+	Typing   bool   `json:"typing"`
+}
+
+// AckPayload is the payload of an ack frame.
+type AckPayload struct {
+	ID        string     `json:"id"`                  // ID of the acknowledged frame
+	MessageID string     `json:"messageID,omitempty"` // Persisted message ID, for message frames
+	CreatedAt *time.Time `json:"createdAt,omitempty"` // Persisted message timestamp, for message frames
+	Duplicate bool       `json:"duplicate,omitempty"` // The message was already stored by an earlier send
+}
+
+// ErrorPayload is the payload of an error frame.
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PresencePayload is the payload of a presence frame. Clients send only a
+// status of "online" or "away"; the server broadcasts the user's overall status.
+type PresencePayload struct {
+	UserID     string     `json:"userID,omitempty"`
+	Status     string     `json:"status"`
+	LastSeenAt *time.Time `json:"lastSeenAt,omitempty"`
+}
+
+// EditPayload is the payload of an edit frame.
+type EditPayload struct {
+	MessageID string    `json:"messageID"`
+	RoomID    string    `json:"roomID"`
+	Content   string    `json:"content"`
+	EditedAt  time.Time `json:"editedAt"`
+	Mentions  []string  `json:"mentions"` // Members mentioned by the new content
+}
+
+// DeletePayload is the payload of a delete frame.
+type DeletePayload struct {
+	MessageID string    `json:"messageID"`
+	RoomID    string    `json:"roomID"`
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+// ReactionPayload is the payload of a reaction frame.
+type ReactionPayload struct {
+	MessageID string `json:"messageID"`
+	RoomID    string `json:"roomID"`
+	UserID    string `json:"userID"` // User who reacted
+	Emoji     string `json:"emoji"`
+	Added     bool   `json:"added"` // False when the reaction was removed
+	Count     int    `json:"count"` // Number of users reacting with this emoji now
+}
+
+// ReadPayload is the payload of a read frame. Clients send roomID and
+// optionally messageID; the server fills in the rest when broadcasting.
+type ReadPayload struct {
+	RoomID    string     `json:"roomID"`
+	UserID    string     `json:"userID,omitempty"`
+	MessageID string     `json:"messageID,omitempty"` // Defaults to the newest message
+	Seq       int64      `json:"seq,omitempty"`
+	ReadAt    *time.Time `json:"readAt,omitempty"`
+}
+
+// LinkPreviewPayload is the payload of a link_preview frame. Previews replace
+// any previews the client shows for the message; an edit drops them until the
+// previews of the new content arrive.
+type LinkPreviewPayload struct {
+	MessageID string        `json:"messageID"`
+	RoomID    string        `json:"roomID"`
+	Previews  []LinkPreview `json:"previews"`
+}
+
+// ChatEventPayload describes a change to a chat. It is the event of a system
+// message and the payload of a chat_event frame. Only the fields relevant to
+// the event are set.
+type ChatEventPayload struct {
+	RoomID    string `json:"roomID"`
+	Event     string `json:"event"`               // One of the ChatEvent constants
+	ActorID   string `json:"actorID"`             // User who made the change
+	TargetID  string `json:"targetID,omitempty"`  // Member the change applies to
+	Name      string `json:"name,omitempty"`      // New chat name
+	AvatarURL string `json:"avatarURL,omitempty"` // New chat avatar
+	Role      string `json:"role,omitempty"`      // New role of the target member
+}
+
+// ErrUnsupportedVersion is returned when a frame declares a newer protocol version.
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// NewEnvelope builds an envelope of the given type around the payload.
+func NewEnvelope(frameType FrameType, id string, payload interface{}) (*Envelope, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s payload: %w", frameType, err)
+	}
+	return &Envelope{Version: ProtocolVersion, Type: frameType, ID: id, Payload: raw}, nil
+}
+
+// NewErrorEnvelope builds an error frame replying to the frame with the given ID.
+func NewErrorEnvelope(id, code, message string) *Envelope {
+	env, err := NewEnvelope(FrameError, id, ErrorPayload{Code: code, Message: message})
+	if err != nil {
+		// ErrorPayload only holds strings, so encoding cannot fail
+		panic(err)
+	}
+	return env
+}
+
+// DecodeEnvelope parses a raw inbound frame and checks its version.
+func DecodeEnvelope(data []byte) (*Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("invalid frame: %w", err)
+	}
+	if env.Type == "" {
+		return nil, errors.New("invalid frame: missing type")
+	}
+	if env.Version == 0 {
+		env.Version = ProtocolVersion
+	}
+	if env.Version < 0 || env.Version > ProtocolVersion {
+		return &env, ErrUnsupportedVersion
+	}
+	return &env, nil
+}
+
+// DecodePayload unmarshals the envelope payload into v.
+func (e *Envelope) DecodePayload(v interface{}) error {
+	if len(e.Payload) == 0 {
+		return errors.New("missing payload")
+	}
+	if err := json.Unmarshal(e.Payload, v); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", e.Type, err)
+	}
+	return nil
+}
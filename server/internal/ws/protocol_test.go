@@ -0,0 +1,76 @@
+package ws
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestDecodeEnvelope(t *testing.T) {
+	tests := []struct {
+		name        string
+		frame       string
+		wantErr     error // nil for a valid frame
+		malformed   bool
+		wantVersion int
+	}{
+		{"current version", fmt.Sprintf(`{"v":%d,"type":"message","id":"1","payload":{}}`, ProtocolVersion), nil, false, ProtocolVersion},
+		{"missing version", `{"type":"message","id":"1"}`, nil, false, ProtocolVersion},
+		{"version 0", `{"v":0,"type":"message","id":"1"}`, nil, false, ProtocolVersion},
+		{"negative version", `{"v":-1,"type":"message","id":"1"}`, ErrUnsupportedVersion, false, -1},
+		{"newer version", fmt.Sprintf(`{"v":%d,"type":"message","id":"1"}`, ProtocolVersion+1), ErrUnsupportedVersion, false, ProtocolVersion + 1},
+		{"not JSON", `{"v":1,"type":`, nil, true, 0},
+		{"not an object", `["message"]`, nil, true, 0},
+		{"version is not a number", `{"v":"1","type":"message"}`, nil, true, 0},
+		{"missing type", `{"v":1,"id":"1"}`, nil, true, 0},
+	}
+	for _, tt := range tests {
+		env, err := DecodeEnvelope([]byte(tt.frame))
+		switch {
+		case tt.malformed:
+			if err == nil || errors.Is(err, ErrUnsupportedVersion) {
+				t.Errorf("%s: err = %v, want a malformed frame error", tt.name, err)
+			}
+		case tt.wantErr != nil:
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+				continue
+			}
+			// The error frame echoes the frame ID and names the version
+			if env == nil || env.ID != "1" || env.Version != tt.wantVersion {
+				t.Errorf("%s: envelope = %+v, want ID 1 and version %d", tt.name, env, tt.wantVersion)
+			}
+		default:
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+				continue
+			}
+			if env.Type != FrameMessage || env.ID != "1" || env.Version != tt.wantVersion {
+				t.Errorf("%s: envelope = %+v", tt.name, env)
+			}
+		}
+	}
+}
+
+func TestHandleFrameRejectsUnknownType(t *testing.T) {
+	env, err := DecodeEnvelope([]byte(`{"v":1,"type":"shout","id":"42","payload":{}}`))
+	if err != nil {
+		t.Fatalf("unknown types are rejected by the handler, not the decoder: %v", err)
+	}
+
+	c := &Client{ID: "user", Send: make(chan *Envelope, 1)}
+	c.handleFrame(nil, env)
+
+	select {
+	case reply := <-c.Send:
+		var payload ErrorPayload
+		if err := reply.DecodePayload(&payload); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Type != FrameError || reply.ID != "42" || payload.Code != ErrCodeUnknownType {
+			t.Errorf("reply = %+v with %+v, want an %s error for frame 42", reply, payload, ErrCodeUnknownType)
+		}
+	default:
+		t.Fatal("no reply to a frame of unknown type")
+	}
+}
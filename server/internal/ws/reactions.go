@@ -0,0 +1,118 @@
+package ws
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxEmojiLength matches the size of message_reactions.emoji.
+const maxEmojiLength = 32
+
+// Reaction is the aggregated count of one emoji on a message.
+type Reaction struct {
+	Emoji       string `json:"emoji"`
+	Count       int    `json:"count"`
+	ReactedByMe bool   `json:"reactedByMe"` // The requesting user added this reaction
+}
+
+// isValidEmoji accepts short strings without whitespace or control characters.
+func isValidEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > maxEmojiLength || !utf8.ValidString(emoji) {
+		return false
+	}
+	return strings.IndexFunc(emoji, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}) == -1
+}
+
+// AddReaction adds the caller's reaction to a message and notifies the chat.
+func (h *Handler) AddReaction(c *gin.Context) {
+	var req struct {
+		Emoji string `json:"emoji"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || !isValidEmoji(req.Emoji) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A valid emoji is required"})
+		return
+	}
+
+	h.setReaction(c, req.Emoji, true)
+}
+
+// RemoveReaction removes the caller's reaction from a message and notifies the chat.
+func (h *Handler) RemoveReaction(c *gin.Context) {
+	emoji := c.Param("emoji")
+	if !isValidEmoji(emoji) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A valid emoji is required"})
+		return
+	}
+
+	h.setReaction(c, emoji, false)
+}
+
+// setReaction adds or removes a reaction and publishes the new count when it changed.
+func (h *Handler) setReaction(c *gin.Context, emoji string, add bool) {
+	messageID := c.Param("id")
+	userID := c.GetString("userID")
+	chatID := c.GetString("chatID")
+
+	var query string
+	if add {
+		var deleted bool
+		err := h.db.QueryRow("SELECT deleted_at IS NOT NULL FROM messages WHERE id = $1", messageID).Scan(&deleted)
+		if err != nil {
+			log.Printf("Error loading message %s for reaction: %v", messageID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update reaction"})
+			return
+		}
+		if deleted {
+			c.JSON(http.StatusConflict, gin.H{"error": "Message has been deleted"})
+			return
+		}
+
+		query = `
+			INSERT INTO message_reactions (message_id, user_id, emoji)
+			VALUES ($1, $2, $3)
+			ON CONFLICT DO NOTHING`
+	} else {
+		query = "DELETE FROM message_reactions WHERE message_id = $1 AND user_id = $2 AND emoji = $3"
+	}
+
+	result, err := h.db.Exec(query, messageID, userID, emoji)
+	if err != nil {
+		log.Printf("Error updating reaction %q of user %s on message %s: %v", emoji, userID, messageID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update reaction"})
+		return
+	}
+	changed, err := result.RowsAffected()
+	if err != nil {
+		log.Printf("Error reading reaction update result: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update reaction"})
+		return
+	}
+
+	var count int
+	err = h.db.QueryRow("SELECT COUNT(*) FROM message_reactions WHERE message_id = $1 AND emoji = $2", messageID, emoji).Scan(&count)
+	if err != nil {
+		log.Printf("Error counting reactions on message %s: %v", messageID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update reaction"})
+		return
+	}
+
+	if changed > 0 {
+		h.hub.Publish(chatID, FrameReaction, ReactionPayload{
+			MessageID: messageID,
+			RoomID:    chatID,
+			UserID:    userID,
+			Emoji:     emoji,
+			Added:     add,
+			Count:     count,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"messageID": messageID, "emoji": emoji, "count": count, "reactedByMe": add})
+}
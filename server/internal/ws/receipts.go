@@ -0,0 +1,151 @@
+package ws
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ReadReceipt is a member's read cursor in a chat.
+type ReadReceipt struct {
+	UserID            string     `json:"userID"`
+	Username          string     `json:"username"`
+	LastReadMessageID string     `json:"lastReadMessageID,omitempty"`
+	LastReadSeq       int64      `json:"lastReadSeq"`
+	ReadAt            *time.Time `json:"readAt,omitempty"`
+}
+
+// markRead advances the user's read cursor in a chat to the given message, or to
+// the newest message when messageID is empty. Cursors never move backwards; when
+// the user had already read further, advanced is false and receipt is nil.
+func markRead(db *sql.DB, chatID, userID, messageID string) (receipt *ReadPayload, advanced bool, err error) {
+	receipt = &ReadPayload{RoomID: chatID, UserID: userID, MessageID: messageID}
+
+	if messageID == "" {
+		err = db.QueryRow("SELECT id, seq FROM messages WHERE chat_id = $1 ORDER BY seq DESC LIMIT 1", chatID).
+			Scan(&receipt.MessageID, &receipt.Seq)
+	} else {
+		if _, parseErr := uuid.Parse(messageID); parseErr != nil {
+			return nil, false, errMessageNotFound
+		}
+		err = db.QueryRow("SELECT seq FROM messages WHERE id = $1 AND chat_id = $2", messageID, chatID).Scan(&receipt.Seq)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, errMessageNotFound
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to load read message: %w", err)
+	}
+
+	var readAt time.Time
+	err = db.QueryRow(`
+		UPDATE chat_members
+		SET last_read_message = $3, last_read_seq = $4, last_read_at = CURRENT_TIMESTAMP
+		WHERE chat_id = $1 AND user_id = $2 AND last_read_seq < $4
+		RETURNING last_read_at`,
+		chatID, userID, receipt.MessageID, receipt.Seq).Scan(&readAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to update read cursor: %w", err)
+	}
+
+	receipt.ReadAt = &readAt
+	return receipt, true, nil
+}
+
+// MarkRead advances the caller's read cursor and pushes a read event to the chat.
+func (h *Handler) MarkRead(c *gin.Context) {
+	chatID := c.Param("chatID")
+	userID := c.GetString("userID")
+
+	var req struct {
+		MessageID string `json:"messageID"` // Optional; defaults to the newest message
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+			return
+		}
+	}
+
+	receipt, advanced, err := markRead(h.db, chatID, userID, req.MessageID)
+	if err != nil {
+		log.Printf("Error marking chat %s read for user %s: %v", chatID, userID, err)
+		respondChatAccessError(c, err)
+		return
+	}
+
+	if advanced {
+		h.hub.Publish(chatID, FrameRead, receipt)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"advanced": advanced, "receipt": receipt})
+}
+
+// GetReadReceipts returns the read cursor of every member of a chat.
+func (h *Handler) GetReadReceipts(c *gin.Context) {
+	chatID := c.Param("chatID")
+
+	rows, err := h.db.Query(`
+		SELECT cm.user_id, u.username, COALESCE(cm.last_read_message::text, ''), cm.last_read_seq, cm.last_read_at
+		FROM chat_members cm
+		INNER JOIN users u ON cm.user_id = u.id
+		WHERE cm.chat_id = $1
+		ORDER BY u.username`, chatID)
+	if err != nil {
+		log.Printf("Error fetching read receipts for chat %s: %v", chatID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch read receipts"})
+		return
+	}
+	defer rows.Close()
+
+	receipts := []ReadReceipt{}
+	for rows.Next() {
+		var receipt ReadReceipt
+		if err := rows.Scan(&receipt.UserID, &receipt.Username, &receipt.LastReadMessageID, &receipt.LastReadSeq, &receipt.ReadAt); err != nil {
+			log.Printf("Error parsing read receipts for chat %s: %v", chatID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse read receipts"})
+			return
+		}
+		receipts = append(receipts, receipt)
+	}
+
+	c.JSON(http.StatusOK, receipts)
+}
+
+// handleRead marks a chat read up to the message in the frame.
+func (c *Client) handleRead(hub *Hub, env *Envelope) {
+	var payload ReadPayload
+	if err := env.DecodePayload(&payload); err != nil || payload.RoomID == "" {
+		c.replyError(env.ID, ErrCodeInvalidPayload, "roomID is required")
+		return
+	}
+	if !c.IsSubscribed(payload.RoomID) {
+		c.replyError(env.ID, ErrCodeNotSubscribed, "Subscribe to the chat before marking it read")
+		return
+	}
+
+	receipt, advanced, err := markRead(c.DB, payload.RoomID, c.ID, payload.MessageID)
+	if errors.Is(err, errMessageNotFound) {
+		c.replyError(env.ID, ErrCodeNotFound, "Message not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error marking chat %s read for client %s: %v", payload.RoomID, c.ID, err)
+		c.replyError(env.ID, ErrCodeInternal, "Failed to mark chat read")
+		return
+	}
+
+	c.ack(env.ID)
+	if advanced {
+		hub.Publish(payload.RoomID, FrameRead, receipt)
+	}
+}
@@ -0,0 +1,58 @@
+package ws
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestMarkReadKeepsCursorMonotonic(t *testing.T) {
+	db, store := newTestDB(t, "chat", "other")
+	first := store.addMessage("chat", "bob", "one")
+	second := store.addMessage("chat", "bob", "two")
+	third := store.addMessage("chat", "bob", "three")
+	elsewhere := store.addMessage("other", "bob", "elsewhere")
+	store.readSeq[[2]string{"chat", "alice"}] = 0
+
+	receipt, advanced, err := markRead(db, "chat", "alice", second.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !advanced || receipt.MessageID != second.id || receipt.Seq != second.seq || receipt.ReadAt == nil {
+		t.Fatalf("read up to the second message: advanced = %v, receipt = %+v", advanced, receipt)
+	}
+
+	// Reading an older message again, e.g. on another device, must not move the cursor back
+	for _, msg := range []*fakeMessage{first, second} {
+		receipt, advanced, err := markRead(db, "chat", "alice", msg.id)
+		if err != nil || advanced || receipt != nil {
+			t.Errorf("read seq %d again: advanced = %v, receipt = %+v, err = %v", msg.seq, advanced, receipt, err)
+		}
+	}
+	if seq := store.readSeq[[2]string{"chat", "alice"}]; seq != second.seq {
+		t.Errorf("cursor = %d, want %d", seq, second.seq)
+	}
+
+	// Without a message ID the chat is read up to the newest message
+	receipt, advanced, err = markRead(db, "chat", "alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !advanced || receipt.MessageID != third.id || receipt.Seq != third.seq {
+		t.Errorf("read everything: advanced = %v, receipt = %+v, want seq %d", advanced, receipt, third.seq)
+	}
+
+	for name, messageID := range map[string]string{
+		"unknown message":         uuid.New().String(),
+		"invalid ID":              "not-a-uuid",
+		"message of another chat": elsewhere.id,
+	} {
+		if _, _, err := markRead(db, "chat", "alice", messageID); !errors.Is(err, errMessageNotFound) {
+			t.Errorf("%s: err = %v, want %v", name, err, errMessageNotFound)
+		}
+	}
+	if seq := store.readSeq[[2]string{"chat", "alice"}]; seq != third.seq {
+		t.Errorf("cursor = %d, want %d", seq, third.seq)
+	}
+}
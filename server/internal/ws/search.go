@@ -0,0 +1,259 @@
+package ws
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const (
+	defaultSearchLimit = 20  // Results per page when no limit is given
+	maxSearchLimit     = 50  // Server-side cap on the page size
+	maxSearchLength    = 200 // Longest accepted query, in characters
+)
+
+// Matches are marked with private-use characters by ts_headline, so they can
+// be told apart from user content before the snippet is escaped.
+const (
+	highlightStart = "\uE000"
+	highlightStop  = "\uE001"
+)
+
+var headlineOptions = "StartSel=" + highlightStart + ", StopSel=" + highlightStop +
+	", MinWords=10, MaxWords=30, MaxFragments=2"
+
+// SearchResult is a message matching a search query.
+type SearchResult struct {
+	MessageID string    `json:"messageID"`
+	ChatID    string    `json:"chatID"`
+	SenderID  string    `json:"senderID"`
+	Username  string    `json:"username"`
+	Snippet   string    `json:"snippet"` // Escaped HTML with matches wrapped in <mark>
+	Seq       int64     `json:"seq"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// SearchPage is a page of search results, newest first.
+type SearchPage struct {
+	Results    []SearchResult `json:"results"`
+	NextCursor string         `json:"nextCursor,omitempty"` // Cursor for the page of older results
+}
+
+// searchQuery holds the validated parameters of a message search.
+type searchQuery struct {
+	Text    string
+	ChatIDs []string
+	From    *time.Time // Only messages sent at or after this time
+	To      *time.Time // Only messages sent before this time
+	Cursor  *messageCursor
+	Limit   int
+}
+
+// messageCursor points at the last message of a page ordered by
+// (created_at, id), newest first.
+type messageCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+func (c messageCursor) encode() string {
+	raw := strconv.FormatInt(c.CreatedAt.UnixMicro(), 10) + ":" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeMessageCursor(value string) (*messageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	micros, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return nil, errors.New("invalid cursor")
+	}
+	createdAt, err := strconv.ParseInt(micros, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	return &messageCursor{CreatedAt: time.UnixMicro(createdAt).UTC(), ID: id}, nil
+}
+
+// parseSearchTime accepts an RFC 3339 timestamp or a YYYY-MM-DD date. A date
+// used as an upper bound includes the whole day.
+func parseSearchTime(value string, upper bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if upper {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// parseSearchQuery reads the q, chatID, from, to, cursor and limit query parameters.
+func parseSearchQuery(c *gin.Context) (searchQuery, error) {
+	query := searchQuery{Text: strings.TrimSpace(c.Query("q")), Limit: defaultSearchLimit}
+	if query.Text == "" {
+		return query, errors.New("q is required")
+	}
+	if utf8.RuneCountInString(query.Text) > maxSearchLength {
+		return query, fmt.Errorf("q must be at most %d characters", maxSearchLength)
+	}
+
+	for _, chatID := range c.QueryArray("chatID") {
+		if _, err := uuid.Parse(chatID); err != nil {
+			return query, errors.New("invalid chatID")
+		}
+		query.ChatIDs = append(query.ChatIDs, chatID)
+	}
+
+	for name, dst := range map[string]**time.Time{"from": &query.From, "to": &query.To} {
+		raw := c.Query(name)
+		if raw == "" {
+			continue
+		}
+		value, err := parseSearchTime(raw, name == "to")
+		if err != nil {
+			return query, fmt.Errorf("invalid %s date", name)
+		}
+		*dst = &value
+	}
+	if query.From != nil && query.To != nil && !query.From.Before(*query.To) {
+		return query, errors.New("from must be before to")
+	}
+
+	if raw := c.Query("cursor"); raw != "" {
+		cursor, err := decodeMessageCursor(raw)
+		if err != nil {
+			return query, err
+		}
+		query.Cursor = cursor
+	}
+
+	if raw := c.Query("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 {
+			return query, errors.New("invalid limit")
+		}
+		query.Limit = limit
+	}
+	if query.Limit > maxSearchLimit {
+		query.Limit = maxSearchLimit
+	}
+	return query, nil
+}
+
+// highlightSnippet escapes a snippet returned by ts_headline and turns its
+// match markers into <mark> tags.
+func highlightSnippet(snippet string) string {
+	snippet = html.EscapeString(snippet)
+	snippet = strings.ReplaceAll(snippet, highlightStart, "<mark>")
+	return strings.ReplaceAll(snippet, highlightStop, "</mark>")
+}
+
+// SearchMessages finds messages matching q in the chats the caller belongs to.
+// The query uses web search syntax: quoted phrases, OR and -excluded words.
+// Results can be limited to chats with one or more chatID parameters and to
+// a time range with from and to. Pass the returned nextCursor as cursor to
+// get the next page.
+func (h *Handler) SearchMessages(c *gin.Context) {
+	userID := c.GetString("userID")
+
+	query, err := parseSearchQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Markers are stripped from the content so only ts_headline can produce them
+	args := []interface{}{userID, query.Text, headlineOptions, highlightStart + highlightStop}
+	conditions := []string{
+		"m.search_vector @@ q.query",
+		"m.kind = 'user'",
+		"m.deleted_at IS NULL",
+		visibleTo("$1"),
+	}
+	addCondition := func(format string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(format, len(args)))
+	}
+	if len(query.ChatIDs) > 0 {
+		addCondition("m.chat_id = ANY($%d::uuid[])", pq.Array(query.ChatIDs))
+	}
+	// created_at has no time zone and holds UTC times
+	if query.From != nil {
+		addCondition("m.created_at >= $%d::timestamp", query.From.UTC())
+	}
+	if query.To != nil {
+		addCondition("m.created_at < $%d::timestamp", query.To.UTC())
+	}
+	if query.Cursor != nil {
+		args = append(args, query.Cursor.CreatedAt, query.Cursor.ID)
+		conditions = append(conditions, fmt.Sprintf("(m.created_at, m.id) < ($%d::timestamp, $%d::uuid)", len(args)-1, len(args)))
+	}
+	args = append(args, query.Limit+1)
+
+	rows, err := h.db.Query(`
+		SELECT
+			m.id,
+			m.chat_id,
+			m.sender_id,
+			u.username,
+			ts_headline('simple', translate(m.content, $4, ''), q.query, $3),
+			m.seq,
+			m.created_at
+		FROM messages m
+		INNER JOIN chat_members cm ON cm.chat_id = m.chat_id AND cm.user_id = $1
+		INNER JOIN users u ON u.id = m.sender_id
+		CROSS JOIN websearch_to_tsquery('simple', $2) AS q(query)
+		WHERE `+strings.Join(conditions, " AND ")+`
+		ORDER BY m.created_at DESC, m.id DESC
+		LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		log.Printf("Error searching messages for user %s: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+	defer rows.Close()
+
+	page := SearchPage{Results: []SearchResult{}}
+	for rows.Next() {
+		var result SearchResult
+		if err := rows.Scan(&result.MessageID, &result.ChatID, &result.SenderID, &result.Username, &result.Snippet, &result.Seq, &result.CreatedAt); err != nil {
+			log.Printf("Error scanning search result for user %s: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+		result.Snippet = highlightSnippet(result.Snippet)
+		page.Results = append(page.Results, result)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error iterating search results for user %s: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return
+	}
+
+	if len(page.Results) > query.Limit {
+		page.Results = page.Results[:query.Limit]
+		last := page.Results[len(page.Results)-1]
+		page.NextCursor = messageCursor{CreatedAt: last.CreatedAt, ID: last.MessageID}.encode()
+	}
+	c.JSON(http.StatusOK, page)
+}
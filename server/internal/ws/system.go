@@ -0,0 +1,57 @@
+package ws
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// Message kinds
+const (
+	MessageKindUser   = "user"   // Sent by a chat member
+	MessageKindSystem = "system" // Generated by the server for a chat event
+)
+
+// queryRower is implemented by *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// saveSystemMessage records a chat event in the chat's history as a system
+// message sent by the event's actor. Call it in the transaction that made the
+// change so history and state cannot disagree.
+func saveSystemMessage(q queryRower, event ChatEventPayload) (*Message, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s event: %w", event.Event, err)
+	}
+
+	msg := &Message{
+		RoomID:    event.RoomID,
+		SenderID:  event.ActorID,
+		Kind:      MessageKindSystem,
+		Event:     &event,
+		Reactions: []Reaction{},
+		SeenBy:    []string{},
+	}
+	err = q.QueryRow(`
+		WITH next AS (
+			UPDATE chats SET last_seq = last_seq + 1 WHERE id = $1 RETURNING last_seq
+		)
+		INSERT INTO messages (chat_id, sender_id, content, kind, event, seq)
+		SELECT $1, $2, '', $3, $4, last_seq FROM next
+		RETURNING id, seq, created_at, (SELECT username FROM users WHERE id = $2)`,
+		event.RoomID, event.ActorID, MessageKindSystem, data,
+	).Scan(&msg.ID, &msg.Seq, &msg.CreatedAt, &msg.Username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save %s system message: %w", event.Event, err)
+	}
+	return msg, nil
+}
+
+// broadcastSystemMessages pushes committed system messages to their chats.
+func (h *Handler) broadcastSystemMessages(messages ...*Message) {
+	for _, msg := range messages {
+		h.hub.Broadcast <- msg
+	}
+}
@@ -0,0 +1,54 @@
+package ws
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Thread is a message together with its replies.
+type Thread struct {
+	Parent  *Message  `json:"parent"`
+	Replies []Message `json:"replies"`
+}
+
+// GetThread returns a message and the replies to it visible to the caller, oldest first.
+func (h *Handler) GetThread(c *gin.Context) {
+	messageID := c.Param("id")
+	userID := c.GetString("userID")
+
+	rows, err := h.db.Query(`
+		SELECT `+messageColumns("$2")+`
+		FROM `+messageTables+`
+		WHERE (m.id = $1 OR m.reply_to_id = $1) AND `+visibleTo("$2")+`
+		ORDER BY m.seq ASC`, messageID, userID)
+	if err != nil {
+		log.Printf("Error fetching thread of message %s: %v", messageID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch thread"})
+		return
+	}
+	defer rows.Close()
+
+	thread := Thread{Replies: []Message{}}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			log.Printf("Error parsing thread of message %s: %v", messageID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse thread"})
+			return
+		}
+		if msg.ID == messageID {
+			thread.Parent = msg
+		} else {
+			thread.Replies = append(thread.Replies, *msg)
+		}
+	}
+
+	if thread.Parent == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, thread)
+}
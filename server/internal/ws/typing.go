@@ -0,0 +1,114 @@
+package ws
+
+import (
+	"log"
+	"time"
+)
+
+// typingTTL is how long a typing indicator lasts without a refresh. Clients
+// resend typing_start every few seconds while the user keeps typing, so a
+// crashed client's indicator disappears on its own.
+const typingTTL = 6 * time.Second
+
+// TypingUpdate reports that a user started or stopped typing in a chat.
+type TypingUpdate struct {
+	RoomID   string
+	UserID   string
+	Username string
+	Typing   bool
+}
+
+type typingEntry struct {
+	username  string
+	expiresAt time.Time
+}
+
+// typingState tracks who is typing per chat and user. It is only accessed
+// from the Hub.Run goroutine.
+type typingState map[string]map[string]*typingEntry
+
+// applyTyping records a typing update and notifies the chat when the user's
+// state changed. Refreshes of an active indicator only extend its expiry.
+func (h *Hub) applyTyping(update *TypingUpdate) {
+	room := h.typing[update.RoomID]
+	entry, active := room[update.UserID]
+
+	if !update.Typing {
+		if active {
+			delete(room, update.UserID)
+			if len(room) == 0 {
+				delete(h.typing, update.RoomID)
+			}
+			h.publishTyping(update.RoomID, update.UserID, entry.username, false)
+		}
+		return
+	}
+
+	if active {
+		entry.expiresAt = time.Now().Add(typingTTL)
+		return
+	}
+	if room == nil {
+		room = make(map[string]*typingEntry)
+		h.typing[update.RoomID] = room
+	}
+	room[update.UserID] = &typingEntry{username: update.Username, expiresAt: time.Now().Add(typingTTL)}
+	h.publishTyping(update.RoomID, update.UserID, update.Username, true)
+}
+
+// expireTyping stops indicators that were not refreshed in time.
+func (h *Hub) expireTyping(now time.Time) {
+	for roomID, room := range h.typing {
+		for userID, entry := range room {
+			if now.After(entry.expiresAt) {
+				log.Printf("Typing indicator of user %s in chat %s expired", userID, roomID)
+				h.applyTyping(&TypingUpdate{RoomID: roomID, UserID: userID, Typing: false})
+			}
+		}
+	}
+}
+
+// clearTyping stops every indicator of a user, e.g. when their last connection closes.
+func (h *Hub) clearTyping(userID string) {
+	for roomID, room := range h.typing {
+		if _, active := room[userID]; active {
+			h.applyTyping(&TypingUpdate{RoomID: roomID, UserID: userID, Typing: false})
+		}
+	}
+}
+
+// publishTyping sends a typing frame to everyone in the chat except the typing user.
+func (h *Hub) publishTyping(roomID, userID, username string, typing bool) {
+	env, err := NewEnvelope(FrameTyping, "", TypingPayload{
+		RoomID:   roomID,
+		UserID:   userID,
+		Username: username,
+		Typing:   typing,
+	})
+	if err != nil {
+		log.Printf("Failed to encode typing event for chat %s: %v", roomID, err)
+		return
+	}
+	h.broadcastToChat(roomID, env, userID)
+}
+
+// handleTyping forwards a typing_start or typing_stop frame to the hub.
+// Typing frames are ephemeral: they are not persisted and not acknowledged.
+func (c *Client) handleTyping(hub *Hub, env *Envelope, typing bool) {
+	var payload TypingPayload
+	if err := env.DecodePayload(&payload); err != nil || payload.RoomID == "" {
+		c.replyError(env.ID, ErrCodeInvalidPayload, "roomID is required")
+		return
+	}
+	if !c.IsSubscribed(payload.RoomID) {
+		c.replyError(env.ID, ErrCodeNotSubscribed, "Subscribe to the chat before sending typing indicators")
+		return
+	}
+
+	hub.Typing <- &TypingUpdate{
+		RoomID:   payload.RoomID,
+		UserID:   c.ID,
+		Username: c.Username,
+		Typing:   typing,
+	}
+}
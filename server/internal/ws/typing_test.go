@@ -0,0 +1,80 @@
+package ws
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestHub returns a hub with the given connections subscribed to the chat.
+func newTestHub(roomID string, clients ...*Client) *Hub {
+	hub := NewHub()
+	chat := &Chat{ID: roomID, Members: make(map[*Client]bool)}
+	for _, client := range clients {
+		chat.Members[client] = true
+		client.addRoom(roomID)
+	}
+	hub.Chats[roomID] = chat
+	return hub
+}
+
+// nextTyping returns the typing frame queued for the client, if any.
+func nextTyping(t *testing.T, c *Client) (TypingPayload, bool) {
+	t.Helper()
+	select {
+	case env := <-c.Send:
+		var payload TypingPayload
+		if env.Type != FrameTyping {
+			t.Fatalf("frame type = %s, want %s", env.Type, FrameTyping)
+		}
+		if err := env.DecodePayload(&payload); err != nil {
+			t.Fatal(err)
+		}
+		return payload, true
+	default:
+		return TypingPayload{}, false
+	}
+}
+
+func TestExpireTyping(t *testing.T) {
+	typist := &Client{ID: "alice", Username: "alice", Send: make(chan *Envelope, 8)}
+	watcher := &Client{ID: "bob", Username: "bob", Send: make(chan *Envelope, 8)}
+	hub := newTestHub("chat", typist, watcher)
+
+	start := time.Now()
+	hub.applyTyping(&TypingUpdate{RoomID: "chat", UserID: "alice", Username: "alice", Typing: true})
+	if payload, ok := nextTyping(t, watcher); !ok || !payload.Typing || payload.UserID != "alice" || payload.Username != "alice" {
+		t.Fatalf("start: frame = %+v, sent %v", payload, ok)
+	}
+	if _, ok := nextTyping(t, typist); ok {
+		t.Error("the typist was told about their own indicator")
+	}
+
+	// Refreshing an active indicator extends it without another frame
+	hub.applyTyping(&TypingUpdate{RoomID: "chat", UserID: "alice", Username: "alice", Typing: true})
+	if payload, ok := nextTyping(t, watcher); ok {
+		t.Errorf("refresh sent %+v", payload)
+	}
+
+	hub.expireTyping(start.Add(typingTTL - time.Second))
+	if payload, ok := nextTyping(t, watcher); ok {
+		t.Errorf("indicator expired before its TTL: %+v", payload)
+	}
+	if _, active := hub.typing["chat"]["alice"]; !active {
+		t.Fatal("indicator dropped before its TTL")
+	}
+
+	hub.expireTyping(time.Now().Add(typingTTL + time.Second))
+	if payload, ok := nextTyping(t, watcher); !ok || payload.Typing || payload.UserID != "alice" {
+		t.Fatalf("expiry: frame = %+v, sent %v", payload, ok)
+	}
+	if len(hub.typing) != 0 {
+		t.Errorf("typing state after expiry = %v, want empty", hub.typing)
+	}
+
+	// An expired indicator is not stopped twice
+	hub.expireTyping(time.Now().Add(2 * typingTTL))
+	hub.applyTyping(&TypingUpdate{RoomID: "chat", UserID: "alice", Typing: false})
+	if payload, ok := nextTyping(t, watcher); ok {
+		t.Errorf("stopped an expired indicator again: %+v", payload)
+	}
+}
@@ -2,11 +2,14 @@ package ws
 
 import (
 	"database/sql"
-	"fmt"
+	"errors"
 	"log"
 	"net/http"
+	"server/internal/storage"
+	"server/internal/user"
 	"server/util"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,12 +20,15 @@ import (
 )
 
 type Handler struct {
-	hub *Hub
-	db  *sql.DB
+	hub     *Hub
+	db      *sql.DB
+	storage storage.Storage
+	users   user.Repository
+	tokens  *util.TokenIssuer
 }
 
-func NewHandler(h *Hub, db *sql.DB) *Handler {
-	return &Handler{hub: h, db: db}
+func NewHandler(h *Hub, db *sql.DB, store storage.Storage, users user.Repository, tokens *util.TokenIssuer) *Handler {
+	return &Handler{hub: h, db: db, storage: store, users: users, tokens: tokens}
 }
 
 var upgrader = websocket.Upgrader{
@@ -50,7 +56,7 @@ func (h *Handler) ValidateToken(c *gin.Context) {
 	}
 
 	token = strings.TrimPrefix(token, "Bearer ")
-	claims, err := util.ValidateToken(token,false)
+	claims, err := h.tokens.ValidateToken(token)
 	if err != nil {
 		log.Printf("Token validation failed: %v", err)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
@@ -88,12 +94,14 @@ func (h *Handler) StartChat(c *gin.Context) {
         return
     }
 
-    // Check if a one-on-one or group chat already exists
+    // Check if a one-on-one or group chat already exists. Groups only match
+    // requests for more than two members, so a group that shrank to two is
+    // not taken for a one-on-one chat.
     query := `
-        SELECT c.id
+        SELECT c.id, c.name
         FROM chats c
         INNER JOIN chat_members cm ON c.id = cm.chat_id
-        WHERE c.id IN (
+        WHERE (NOT c.is_group OR $2 > 2) AND c.id IN (
             SELECT chat_id
             FROM chat_members
             WHERE user_id = ANY($1::uuid[])
@@ -102,7 +110,8 @@ func (h *Handler) StartChat(c *gin.Context) {
         )
     `
     var existingChatID string
-    err := h.db.QueryRow(query, pq.Array(req.Members), len(req.Members)).Scan(&existingChatID)
+    var existingName sql.NullString
+    err := h.db.QueryRow(query, pq.Array(req.Members), len(req.Members)).Scan(&existingChatID, &existingName)
     if err == nil {
         // Chat exists, ensure the requesting user is a member
         log.Printf("Chat already exists: ChatID=%s", existingChatID)
@@ -154,6 +163,8 @@ func (h *Handler) StartChat(c *gin.Context) {
             } else {
                 chatName = otherUsername
             }
+        } else if existingName.Valid && existingName.String != "" {
+            chatName = existingName.String
         } else {
             chatName = "Group Chat"
         }
@@ -191,8 +202,9 @@ func (h *Handler) StartChat(c *gin.Context) {
         chatName = "Chat with Yourself"
     }
 
-    // Insert the new chat
-    _, err = h.db.Exec("INSERT INTO chats (id, name) VALUES ($1, $2)", chatID, chatName)
+    // Insert the new chat; unnamed chats of more than two users are groups
+    isGroup := len(req.Members) > 2
+    _, err = h.db.Exec("INSERT INTO chats (id, name, creator_id, is_group) VALUES ($1, $2, $3, $4)", chatID, chatName, requestingUserID, isGroup)
     if err != nil {
         log.Printf("Error creating new chat: %v", err)
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create chat"})
@@ -215,7 +227,11 @@ func (h *Handler) StartChat(c *gin.Context) {
     }()
 
     for _, memberID := range req.Members {
-        _, err := tx.Exec("INSERT INTO chat_members (chat_id, user_id) VALUES ($1, $2)", chatID, memberID)
+        role := RoleMember
+        if memberID == requestingUserID {
+            role = RoleOwner
+        }
+        _, err := tx.Exec("INSERT INTO chat_members (chat_id, user_id, role) VALUES ($1, $2, $3)", chatID, memberID, role)
         if err != nil {
             tx.Rollback()
             log.Printf("Error adding member: ChatID=%s, MemberID=%s, Error=%v", chatID, memberID, err)
@@ -262,72 +278,25 @@ func (h *Handler) JoinChat(c *gin.Context) {
         return
     }
 
-    claims, err := util.ValidateToken(token, false)
-    if err != nil || claims.ID != userID || claims.Username != username {
-        log.Printf("Invalid token or token mismatch for user: %s, Error: %v", username, err)
-        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-        return
-    }
-
-    // Check if chat exists
-    var chatExists bool
-    err = h.db.QueryRow("SELECT EXISTS (SELECT 1 FROM chats WHERE id = $1)", chatID).Scan(&chatExists)
-    if err != nil {
-        log.Printf("Database error while checking chat existence for ChatID=%s: %v", chatID, err)
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
-        return
-    }
-
-    if !chatExists {
-        log.Printf("Chat not found in database: ChatID=%s", chatID)
-        c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
-        return
-    }
-
-    // Synchronize chat with hub if missing (thread-safe)
-    h.hub.mu.Lock()
-    if _, exists := h.hub.Chats[chatID]; !exists {
-        log.Printf("Chat %s not found in hub, synchronizing with database", chatID)
-
-        var chatName string
-        err := h.db.QueryRow("SELECT name FROM chats WHERE id = $1", chatID).Scan(&chatName)
-        if err != nil {
-            h.hub.mu.Unlock()
-            log.Printf("Error fetching chat name for ChatID=%s: %v", chatID, err)
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+    // Optional cursor: replay messages with a greater sequence number before live delivery
+    since := int64(-1)
+    if sinceParam := c.Query("since"); sinceParam != "" {
+        parsed, err := strconv.ParseInt(sinceParam, 10, 64)
+        if err != nil || parsed < 0 {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid since cursor"})
             return
         }
-
-        h.hub.Chats[chatID] = &Chat{
-            ID:      chatID,
-            Name:    chatName,
-            Members: make(map[string]*Client),
-        }
-        log.Printf("Chat %s synchronized with hub", chatID)
-    }
-    h.hub.mu.Unlock()
-
-    // Validate user membership in the chat
-    var isMember bool
-    err = h.db.QueryRow(`
-        SELECT EXISTS (
-            SELECT 1 
-            FROM chat_members 
-            WHERE chat_id = $1 AND user_id = $2
-        )
-    `, chatID, userID).Scan(&isMember)
-    if err != nil {
-        log.Printf("Error validating user membership for ChatID=%s, UserID=%s: %v", chatID, userID, err)
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
-        return
+        since = parsed
     }
 
-    if !isMember {
-        log.Printf("User %s is not a member of chat %s", userID, chatID)
-        c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("User %s is not a member of chat %s", userID, chatID)})
+    claims, err := h.tokens.ValidateToken(token)
+    if err != nil || claims.ID != userID || claims.Username != username {
+        log.Printf("Invalid token or token mismatch for user: %s, Error: %v", username, err)
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
         return
     }
 
+    // Chat existence and membership are enforced by RequireChatMember
     // Upgrade to WebSocket
     conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
     if err != nil {
@@ -338,34 +307,72 @@ func (h *Handler) JoinChat(c *gin.Context) {
 
     client := &Client{
         Conn:     conn,
-        Message:  make(chan *Message, 10),
+        Send:     make(chan *Envelope, 10),
         ID:       userID,
         RoomID:   chatID,
         Username: username,
         DB:       h.db,
+        Users:    h.users,
     }
 
-    // Add client to the chat room in a thread-safe manner
-    h.hub.mu.Lock()
-    h.hub.Chats[chatID].Members[userID] = client
-    h.hub.mu.Unlock()
+    // Register the connection and subscribe it to the requested chat,
+    // replaying missed messages first when a cursor was given
+    h.hub.Register <- client
+    if since >= 0 {
+        if err := client.catchUp(h.hub, chatID, since, client.writeFrame); err != nil {
+            log.Printf("Error replaying chat %s to user %s: %v", chatID, username, err)
+            h.hub.Unregister <- client
+            conn.Close()
+            return
+        }
+    } else {
+        h.hub.Subscribe <- &Subscription{Client: client, RoomID: chatID}
+    }
 
     log.Printf("User %s joined chat %s", username, chatID)
 
-    defer func() {
-        h.hub.mu.Lock()
-        delete(h.hub.Chats[chatID].Members, userID)
-        h.hub.mu.Unlock()
-        client.Conn.Close()
-        log.Printf("User %s left chat %s", username, chatID)
-    }()
-
     // Start WebSocket read/write handling
     go client.StartHeartbeat()
     go client.writeMessage()
     client.readMessage(h.hub)
 }
 
+// Connect establishes a single WebSocket connection for the authenticated user.
+// The client subscribes to and unsubscribes from chats with subscribe/unsubscribe frames.
+func (h *Handler) Connect(c *gin.Context) {
+	userID := c.GetString("userID")
+	username := c.GetString("username")
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "WebSocket upgrade failed"})
+		return
+	}
+
+	client := &Client{
+		Conn:     conn,
+		Send:     make(chan *Envelope, 32),
+		ID:       userID,
+		Username: username,
+		DB:       h.db,
+		Users:    h.users,
+	}
+	h.hub.Register <- client
+
+	log.Printf("User %s connected to the multiplexed WebSocket", username)
+
+	go client.StartHeartbeat()
+	go client.writeMessage()
+	client.readMessage(h.hub)
+}
+
+// GetUserChats lists the caller's chats, most recently active first, with
+// their unread count and a preview of the last message.
 func (h *Handler) GetUserChats(c *gin.Context) {
     userID := c.GetString("userID")
     if userID == "" {
@@ -378,8 +385,9 @@ func (h *Handler) GetUserChats(c *gin.Context) {
         SELECT 
             c.id,
             CASE
-                WHEN COUNT(DISTINCT u.id) = 1 THEN 'Chat with Yourself' -- Self-chat
-                WHEN COUNT(DISTINCT u.id) = 2 THEN (
+                WHEN c.is_group THEN c.name -- Named group chat
+                WHEN mc.count = 1 THEN 'Chat with Yourself' -- Self-chat
+                WHEN mc.count = 2 THEN (
                     SELECT username 
                     FROM users u2 
                     WHERE u2.id = (
@@ -390,17 +398,44 @@ func (h *Handler) GetUserChats(c *gin.Context) {
                         LIMIT 1
                     )
                 ) -- One-on-one chat
-                WHEN COUNT(DISTINCT u.id) > 2 THEN 'Group Chat' -- Group chat
+                WHEN mc.count > 2 THEN 'Group Chat' -- Group chat
                 ELSE 'Unknown Chat'
-            END AS name
-        FROM chats c
-        INNER JOIN chat_members cm ON c.id = cm.chat_id
-        INNER JOIN users u ON cm.user_id = u.id
-        WHERE c.id IN (
-            SELECT chat_id FROM chat_members WHERE user_id = $1
-        )
-        GROUP BY c.id
-        ORDER BY c.id;
+            END AS name,
+            c.is_group,
+            c.avatar_url,
+            (
+                SELECT COUNT(*) 
+                FROM messages m 
+                WHERE m.chat_id = c.id 
+                AND m.seq > me.last_read_seq 
+                AND m.sender_id != $1 
+                AND m.kind = 'user'
+                AND m.deleted_at IS NULL
+                AND ` + visibleTo("$1") + `
+            ) AS unread_count,
+            lm.id,
+            lm.sender_id,
+            lu.username,
+            lm.kind,
+            lm.content,
+            lm.created_at,
+            lm.deleted_at IS NOT NULL,
+            COALESCE(lm.created_at, c.created_at) AS last_activity_at
+        FROM chat_members me
+        INNER JOIN chats c ON c.id = me.chat_id
+        CROSS JOIN LATERAL (
+            SELECT COUNT(*) AS count FROM chat_members WHERE chat_id = c.id
+        ) mc
+        LEFT JOIN LATERAL (
+            SELECT m.id, m.sender_id, m.kind, m.content, m.created_at, m.deleted_at
+            FROM messages m
+            WHERE m.chat_id = c.id AND ` + visibleTo("$1") + `
+            ORDER BY m.seq DESC
+            LIMIT 1
+        ) lm ON true
+        LEFT JOIN users lu ON lu.id = lm.sender_id
+        WHERE me.user_id = $1
+        ORDER BY last_activity_at DESC, c.id;
     `
 
     rows, err := h.db.Query(query, userID)
@@ -411,14 +446,35 @@ func (h *Handler) GetUserChats(c *gin.Context) {
     }
     defer rows.Close()
 
-    var chats []Chat
+    chats := []ChatSummary{}
     for rows.Next() {
-        var chat Chat
-        if err := rows.Scan(&chat.ID, &chat.Name); err != nil {
+        var chat ChatSummary
+        var avatarURL, lastID, lastSenderID, lastUsername, lastKind, lastContent sql.NullString
+        var lastCreatedAt sql.NullTime
+        var lastDeleted bool
+        err := rows.Scan(
+            &chat.ID, &chat.Name, &chat.IsGroup, &avatarURL, &chat.UnreadCount,
+            &lastID, &lastSenderID, &lastUsername, &lastKind, &lastContent, &lastCreatedAt, &lastDeleted,
+            &chat.LastActivityAt,
+        )
+        if err != nil {
             log.Printf("Error scanning user chats for userID=%s: %v", userID, err)
             c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse chat data"})
             return
         }
+
+        chat.AvatarURL = avatarURL.String
+        if lastID.Valid {
+            chat.LastMessage = &MessagePreview{
+                ID:        lastID.String,
+                SenderID:  lastSenderID.String,
+                Username:  lastUsername.String,
+                Kind:      lastKind.String,
+                Content:   previewText(lastContent.String),
+                CreatedAt: lastCreatedAt.Time,
+                Deleted:   lastDeleted,
+            }
+        }
         chats = append(chats, chat)
     }
 
@@ -439,27 +495,50 @@ func (h *Handler) GetChatDetails(c *gin.Context) {
     }
 
     var chat struct {
-        ID      string   `json:"id"`
-        Name    string   `json:"name"`
-        Members []string `json:"members"`
+        ID        string            `json:"id"`
+        Name      string            `json:"name"`
+        IsGroup   bool              `json:"isGroup"`
+        AvatarURL string            `json:"avatarURL,omitempty"`
+        Members   []string          `json:"members"`
+        Roles     map[string]string `json:"roles,omitempty"`      // Role per member, for group chats
+        Avatars   map[string]string `json:"avatarURLs,omitempty"` // Avatar URL per member with an avatar
     }
 
     query := `
-        SELECT c.id, c.name, ARRAY_AGG(cm.user_id) AS members
+        SELECT c.id, c.name, c.is_group, c.avatar_url,
+            ARRAY_AGG(cm.user_id ORDER BY cm.user_id) AS members,
+            ARRAY_AGG(cm.role ORDER BY cm.user_id) AS roles,
+            ARRAY_AGG(COALESCE(u.avatar_id::text, '') ORDER BY cm.user_id) AS avatars
         FROM chats c
         LEFT JOIN chat_members cm ON c.id = cm.chat_id
+        LEFT JOIN users u ON u.id = cm.user_id
         WHERE c.id = $1
         GROUP BY c.id
     `
-    err := h.db.QueryRow(query, chatID).Scan(&chat.ID, &chat.Name, pq.Array(&chat.Members))
+    var avatarURL sql.NullString
+    var roles, avatarIDs []string
+    err := h.db.QueryRow(query, chatID).Scan(&chat.ID, &chat.Name, &chat.IsGroup, &avatarURL, pq.Array(&chat.Members), pq.Array(&roles), pq.Array(&avatarIDs))
     if err != nil {
         log.Printf("Error fetching chat details for chatID: %s, Error: %v", chatID, err)
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch chat details"})
         return
     }
+    chat.AvatarURL = avatarURL.String
+    chat.Avatars = make(map[string]string)
+    for i, member := range chat.Members {
+        if avatarIDs[i] != "" {
+            chat.Avatars[member] = util.AvatarURL(avatarIDs[i])
+        }
+    }
+    if chat.IsGroup {
+        chat.Roles = make(map[string]string, len(chat.Members))
+        for i, member := range chat.Members {
+            chat.Roles[member] = roles[i]
+        }
+    }
 
     // Determine chat name dynamically for one-on-one chats
-    if len(chat.Members) == 2 {
+    if !chat.IsGroup && len(chat.Members) == 2 {
         var otherUserID string
         for _, member := range chat.Members {
             if member != userID {
@@ -476,6 +555,7 @@ func (h *Handler) GetChatDetails(c *gin.Context) {
         } else {
             chat.Name = otherUsername
         }
+        chat.AvatarURL = chat.Avatars[otherUserID]
     }
 
     c.JSON(http.StatusOK, chat)
@@ -483,8 +563,11 @@ func (h *Handler) GetChatDetails(c *gin.Context) {
 
 func (h *Handler) SendMessage(c *gin.Context) {
     var req struct {
-        ChatID  string `json:"chatID"`
-        Content string `json:"content"`
+        ChatID          string `json:"chatID"`
+        ClientMessageID string `json:"clientMessageID"`
+        ReplyToID       string   `json:"replyToID"`
+        Content         string   `json:"content"`
+        AttachmentIDs   []string `json:"attachmentIDs"`
     }
 
     if err := c.ShouldBindJSON(&req); err != nil {
@@ -499,112 +582,79 @@ func (h *Handler) SendMessage(c *gin.Context) {
         return
     }
 
-    // Validate that the `chatID` exists in the `chats` table
-    var exists bool
-    err := h.db.QueryRow("SELECT EXISTS (SELECT 1 FROM chats WHERE id = $1)", req.ChatID).Scan(&exists)
-    if err != nil {
-        log.Printf("Error checking chat existence: %v", err)
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
-        return
-    }
-
-    if !exists {
-        log.Printf("Chat ID does not exist: %s", req.ChatID)
-        c.JSON(http.StatusBadRequest, gin.H{"error": "Chat does not exist"})
+    // Validate that the chat exists and the user belongs to it
+    if err := authorizeChatMember(h.db, req.ChatID, userID); err != nil {
+        log.Printf("User %s cannot send to chat %s: %v", userID, req.ChatID, err)
+        respondChatAccessError(c, err)
         return
     }
 
-    // Validate user membership in the chat
-    var isMember bool
-    err = h.db.QueryRow(`
-        SELECT EXISTS (
-            SELECT 1 
-            FROM chat_members 
-            WHERE chat_id = $1 AND user_id = $2
-        )`, req.ChatID, userID).Scan(&isMember)
-    if err != nil {
-        log.Printf("Error validating user membership: %v", err)
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
-        return
-    }
-    if !isMember {
-        log.Printf("User %s is not a member of chat %s", userID, req.ChatID)
-        c.JSON(http.StatusForbidden, gin.H{"error": "User not a member of this chat"})
-        return
-    }
-
-    // Insert the message
-    query := `INSERT INTO messages (chat_id, sender_id, content) VALUES ($1, $2, $3) RETURNING id, created_at`
-    var message struct {
-        ID        string    `json:"id"`
-        CreatedAt time.Time `json:"created_at"`
+    // Insert the message, deduplicating retries by client message ID
+    msg := &Message{
+        ClientMessageID: req.ClientMessageID,
+        ReplyToID:       req.ReplyToID,
+        RoomID:          req.ChatID,
+        SenderID:        userID,
+        Username:        c.GetString("username"),
+        Content:         req.Content,
+        AttachmentIDs:   req.AttachmentIDs,
     }
 
-    err = h.db.QueryRow(query, req.ChatID, userID, req.Content).Scan(&message.ID, &message.CreatedAt)
+    duplicate, err := saveMessage(h.db, h.users, msg)
     if err != nil {
         log.Printf("Failed to save message: %v", err)
+        if isInvalidMessageError(err) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return
+        }
+        if errors.Is(err, errChatNotFound) {
+            c.JSON(http.StatusNotFound, gin.H{"error": "Chat not found"})
+            return
+        }
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save message"})
         return
     }
 
-    // Broadcast the message to WebSocket clients
-    msg := &Message{
-        ID:        message.ID,
-        RoomID:    req.ChatID,
-        SenderID:  userID,
-        Username:  c.GetString("username"),
-        Content:   req.Content,
-        CreatedAt: message.CreatedAt,
+    // Broadcast the message to WebSocket clients unless it was already delivered
+    if !duplicate {
+        h.hub.Broadcast <- msg
+    } else {
+        log.Printf("Duplicate message %s from user %s, skipping broadcast", req.ClientMessageID, userID)
     }
 
-    h.hub.Broadcast <- msg
-
     c.JSON(http.StatusOK, gin.H{
-        "id":         message.ID,
-        "content":    req.Content,
-        "created_at": message.CreatedAt,
-        "sender_id":  userID,
+        "id":              msg.ID,
+        "clientMessageID": msg.ClientMessageID,
+        "replyToID":       msg.ReplyToID,
+        "content":         msg.Content,
+        "attachments":     msg.Attachments,
+        "created_at":      msg.CreatedAt,
+        "sender_id":       userID,
+        "duplicate":       duplicate,
     })
 }
 
 
+// GetChatMessages returns a page of a chat's messages in sequence order.
+// Without a cursor the most recent page is returned; `before` pages towards
+// older messages and `after` towards newer ones.
 func (h *Handler) GetChatMessages(c *gin.Context) {
 	chatID := c.Param("chatID")
 
-	rows, err := h.db.Query(`
-		SELECT 
-			m.id, 
-			m.sender_id, 
-			u.username, 
-			m.content, 
-			m.created_at 
-		FROM 
-			messages m
-		INNER JOIN 
-			users u ON m.sender_id = u.id
-		WHERE 
-			m.chat_id = $1 
-		ORDER BY 
-			m.created_at ASC`, chatID)
+	query, err := parsePageQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	page, err := loadMessagePage(h.db, chatID, c.GetString("userID"), query)
 	if err != nil {
 		log.Printf("Error fetching messages: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
 		return
 	}
-	defer rows.Close()
-
-	var messages []Message
-	for rows.Next() {
-		var msg Message
-		if err := rows.Scan(&msg.ID, &msg.SenderID, &msg.Username, &msg.Content, &msg.CreatedAt); err != nil {
-			log.Printf("Error parsing messages: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse messages"})
-			return
-		}
-		messages = append(messages, msg)
-	}
 
-	c.JSON(http.StatusOK, messages)
+	c.JSON(http.StatusOK, page)
 }
 
 func (h *Handler) GetAllUsers(c *gin.Context) {
@@ -615,7 +665,7 @@ func (h *Handler) GetAllUsers(c *gin.Context) {
     }
 
     token = strings.TrimPrefix(token, "Bearer ")
-    claims, err := util.ValidateToken(token,false)
+    claims, err := h.tokens.ValidateToken(token)
     if err != nil {
         log.Printf("Token validation failed: %v", err)
         c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
@@ -624,7 +674,7 @@ func (h *Handler) GetAllUsers(c *gin.Context) {
 
     log.Printf("Token validated successfully. UserID: %s", claims.ID)
 
-    rows, err := h.db.Query("SELECT id, username FROM users")
+    rows, err := h.db.Query("SELECT id, username, COALESCE(avatar_id::text, '') FROM users")
     if err != nil {
         log.Printf("Error fetching users: %v", err)
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
@@ -633,20 +683,24 @@ func (h *Handler) GetAllUsers(c *gin.Context) {
     defer rows.Close()
 
     var users []struct {
-        ID       string `json:"id"`
-        Username string `json:"username"`
+        ID        string `json:"id"`
+        Username  string `json:"username"`
+        AvatarURL string `json:"avatarURL,omitempty"`
     }
 
     for rows.Next() {
         var user struct {
-            ID       string `json:"id"`
-            Username string `json:"username"`
+            ID        string `json:"id"`
+            Username  string `json:"username"`
+            AvatarURL string `json:"avatarURL,omitempty"`
         }
-        if err := rows.Scan(&user.ID, &user.Username); err != nil {
+        var avatarID string
+        if err := rows.Scan(&user.ID, &user.Username, &avatarID); err != nil {
             log.Printf("Error scanning user: %v", err)
             c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse users"})
             return
         }
+        user.AvatarURL = util.AvatarURL(avatarID)
         users = append(users, user)
     }
 
@@ -2,6 +2,7 @@ package router
 
 import (
 	"log"
+	"net/http"
 	"os"
 	"server/internal/middleware"
 	"server/internal/user"
@@ -16,7 +17,7 @@ import (
 
 var r *gin.Engine
 
-func InitRouter(userHandler *user.Handler, wsHandler *ws.Handler) {
+func InitRouter(userHandler *user.Handler, wsHandler *ws.Handler, tokens *util.TokenIssuer) {
 	r = gin.Default()
 	r.SetTrustedProxies(nil) // Ensure headers are preserved in Heroku
 
@@ -48,31 +49,86 @@ func InitRouter(userHandler *user.Handler, wsHandler *ws.Handler) {
 		c.Next()
 	})
 
+	// Access token check shared by every authenticated route
+	auth := middleware.AuthMiddleware(tokens)
+
 	// Public Routes
 	r.POST("/signup", userHandler.CreateUser)
 	r.POST("/login", userHandler.Login)
 	r.POST("/auth/refresh-token", userHandler.RefreshToken) // Refresh Token Endpoint
-	r.GET("/logout", userHandler.Logout)
+	r.GET("/avatars/:id", userHandler.GetAvatar)            // Public, so avatars load in <img> tags
+
+	// Public keys other services verify access tokens with
+	r.GET("/.well-known/jwks.json", func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, tokens.JWKS())
+	})
+
+	// Logout Routes, revoking the caller's tokens
+	r.POST("/logout", auth, userHandler.Logout)
+	r.POST("/logout/all", auth, userHandler.LogoutAll) // Every device
 
 	// Validate Token Route
-	r.GET("/validate-token", middleware.AuthMiddleware(), wsHandler.ValidateToken)
+	r.GET("/validate-token", auth, wsHandler.ValidateToken)
 
 	// User-related Authenticated Routes
-	userRoutes := r.Group("/users", middleware.AuthMiddleware())
+	userRoutes := r.Group("/users", auth)
 	{
 		userRoutes.GET("/search", userHandler.SearchUsers)
 		userRoutes.GET("/all", wsHandler.GetAllUsers)
+		userRoutes.GET("/presence", wsHandler.GetPresence)
+		userRoutes.POST("/avatar", userHandler.UploadAvatar)
+		userRoutes.DELETE("/avatar", userHandler.DeleteAvatar)
+		userRoutes.GET("/sessions", userHandler.ListSessions)
+		userRoutes.DELETE("/sessions/:id", userHandler.RevokeSession)
 	}
 
+	// Full-text search over the messages of the caller's chats
+	r.GET("/messages/search", auth, wsHandler.SearchMessages)
+
 	// WebSocket-Related Authenticated Routes
-	authRoutes := r.Group("/ws", middleware.AuthMiddleware())
+	authRoutes := r.Group("/ws", auth)
 	{
 		authRoutes.POST("/startChat", wsHandler.StartChat)
-		authRoutes.GET("/joinChat/:chatID", wsHandler.JoinChat)
+		authRoutes.GET("/connect", wsHandler.Connect)
 		authRoutes.GET("/getUserChats", wsHandler.GetUserChats)
-		authRoutes.GET("/getChatDetails/:chatID", wsHandler.GetChatDetails)
 		authRoutes.POST("/sendMessage", wsHandler.SendMessage)
-		authRoutes.GET("/getChatMessages/:chatID", wsHandler.GetChatMessages)
+		authRoutes.GET("/attachments/:id", wsHandler.DownloadAttachment)
+		authRoutes.GET("/mentions", wsHandler.GetMentions)
+	}
+
+	// Chat-scoped Routes, restricted to members of the chat
+	chatRoutes := r.Group("/ws", auth, wsHandler.RequireChatMember("chatID"))
+	{
+		chatRoutes.GET("/joinChat/:chatID", wsHandler.JoinChat)
+		chatRoutes.GET("/getChatDetails/:chatID", wsHandler.GetChatDetails)
+		chatRoutes.GET("/getChatMessages/:chatID", wsHandler.GetChatMessages)
+		chatRoutes.POST("/markRead/:chatID", wsHandler.MarkRead)
+		chatRoutes.GET("/getReadReceipts/:chatID", wsHandler.GetReadReceipts)
+		chatRoutes.POST("/uploadAttachment/:chatID", wsHandler.UploadAttachment)
+	}
+
+	// Group Management Routes, restricted to members of the group
+	r.POST("/ws/groups", auth, wsHandler.CreateGroup)
+	groupRoutes := r.Group("/ws/groups/:chatID", auth, wsHandler.RequireChatMember("chatID"))
+	{
+		groupRoutes.PUT("", wsHandler.UpdateGroup)
+		groupRoutes.POST("/members", wsHandler.AddMembers)
+		groupRoutes.DELETE("/members/:userID", wsHandler.RemoveMember)
+		groupRoutes.PUT("/members/:userID/role", wsHandler.SetMemberRole)
+		groupRoutes.POST("/leave", wsHandler.LeaveGroup)
+		groupRoutes.POST("/owner", wsHandler.TransferOwnership)
+	}
+
+	// Message-scoped Routes, restricted to members of the message's chat
+	messageRoutes := r.Group("/ws/messages/:id", auth, wsHandler.RequireMessageAccess("id"))
+	{
+		messageRoutes.PUT("", wsHandler.EditMessage)
+		messageRoutes.DELETE("", wsHandler.DeleteMessage)
+		messageRoutes.GET("/edits", wsHandler.GetMessageEdits)
+		messageRoutes.GET("/thread", wsHandler.GetThread)
+		messageRoutes.POST("/reactions", wsHandler.AddReaction)
+		messageRoutes.DELETE("/reactions/:emoji", wsHandler.RemoveReaction)
 	}
 }
 
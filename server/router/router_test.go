@@ -0,0 +1,264 @@
+package router
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"server/internal/storage"
+	"server/internal/user"
+	"server/internal/ws"
+	"server/util"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	memberID   = "11111111-1111-1111-1111-111111111111"
+	outsiderID = "22222222-2222-2222-2222-222222222222"
+	chatID     = "33333333-3333-3333-3333-333333333333"
+	unknownID  = "44444444-4444-4444-4444-444444444444"
+)
+
+// fakeDB answers the queries issued by the chat routes from an in-memory
+// list of chats and members, and records every query it receives.
+type fakeDB struct {
+	mu      sync.Mutex
+	members map[string][]string // Chat ID -> member IDs
+	queries []string
+}
+
+func (f *fakeDB) Open(string) (driver.Conn, error) { return &fakeConn{db: f}, nil }
+
+// ran reports whether a query containing fragment was executed.
+func (f *fakeDB) ran(fragment string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, query := range f.queries {
+		if strings.Contains(query, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeDB) query(query string, args []driver.Value) (driver.Rows, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries = append(f.queries, query)
+
+	switch {
+	case strings.Contains(query, "EXISTS (SELECT 1 FROM chats"):
+		members, exists := f.members[args[0].(string)]
+		isMember := false
+		for _, id := range members {
+			isMember = isMember || id == args[1].(string)
+		}
+		return &fakeRows{columns: []string{"exists", "member"}, values: [][]driver.Value{{exists, isMember}}}, nil
+	case strings.Contains(query, "ARRAY_AGG(cm.user_id"):
+		members := f.members[args[0].(string)]
+		roles := make([]string, len(members))
+		avatars := make([]string, len(members))
+		for i := range members {
+			roles[i], avatars[i] = `"member"`, `""`
+		}
+		return &fakeRows{
+			columns: []string{"id", "name", "is_group", "avatar_url", "members", "roles", "avatars"},
+			values: [][]driver.Value{{
+				args[0], "Group", true, nil,
+				"{" + strings.Join(members, ",") + "}",
+				"{" + strings.Join(roles, ",") + "}",
+				"{" + strings.Join(avatars, ",") + "}",
+			}},
+		}, nil
+	case strings.Contains(query, "ORDER BY m.seq"):
+		return &fakeRows{}, nil
+	default:
+		return nil, fmt.Errorf("unexpected query: %s", query)
+	}
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return nil, errors.New("transactions not supported") }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+func (s *fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("exec not supported")
+}
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) { return s.db.query(s.query, args) }
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+var registerOnce sync.Once
+var testDB = &fakeDB{}
+
+// setupRouter builds the real routes on top of the fake database and returns
+// a function issuing access tokens for them.
+func setupRouter(t *testing.T) func(userID string) string {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	registerOnce.Do(func() { sql.Register("fakechats", testDB) })
+	testDB.mu.Lock()
+	testDB.members = map[string][]string{chatID: {memberID}}
+	testDB.queries = nil
+	testDB.mu.Unlock()
+
+	db, err := sql.Open("fakechats", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	tokens, err := util.NewTokenIssuer(util.TokenIssuerOptions{
+		Issuer:          "test",
+		Audience:        "test-api",
+		AccessTokenTTL:  time.Minute,
+		RefreshTokenTTL: time.Hour,
+		SigningKey:      util.TokenKey{ID: "test", Secret: []byte("secret")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userRep := user.NewRepository(db)
+	userHandler := user.NewHandler(user.NewService(userRep, store, tokens))
+	InitRouter(userHandler, ws.NewHandler(ws.NewHub(), db, store, userRep, tokens), tokens)
+
+	return func(userID string) string {
+		token, err := tokens.IssueAccessToken(userID, "user-"+userID[:4], "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+}
+
+func get(token, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestChatRoutesRequireMembership(t *testing.T) {
+	routes := []struct {
+		name  string
+		path  string
+		query string // Fragment of the query loading the protected data
+	}{
+		{"history", "/ws/getChatMessages/", "ORDER BY m.seq"},
+		{"membership list", "/ws/getChatDetails/", "ARRAY_AGG(cm.user_id"},
+	}
+	cases := []struct {
+		name   string
+		userID string
+		chatID string
+		status int
+	}{
+		{"member", memberID, chatID, http.StatusOK},
+		{"non-member", outsiderID, chatID, http.StatusForbidden},
+		{"unknown chat", memberID, unknownID, http.StatusNotFound},
+		{"malformed chat ID", memberID, "not-a-uuid", http.StatusNotFound},
+	}
+
+	for _, route := range routes {
+		for _, tc := range cases {
+			t.Run(route.name+"/"+tc.name, func(t *testing.T) {
+				issue := setupRouter(t)
+
+				rec := get(issue(tc.userID), route.path+tc.chatID)
+				if rec.Code != tc.status {
+					t.Fatalf("status = %d, want %d; body: %s", rec.Code, tc.status, rec.Body)
+				}
+				if loaded := testDB.ran(route.query); loaded != (tc.status == http.StatusOK) {
+					t.Errorf("chat data loaded = %v for status %d", loaded, rec.Code)
+				}
+			})
+		}
+	}
+}
+
+func TestChatRoutesReturnMemberData(t *testing.T) {
+	issue := setupRouter(t)
+
+	rec := get(issue(memberID), "/ws/getChatDetails/"+chatID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d; body: %s", rec.Code, rec.Body)
+	}
+	var details struct {
+		ID      string   `json:"id"`
+		Members []string `json:"members"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &details); err != nil {
+		t.Fatal(err)
+	}
+	if details.ID != chatID || len(details.Members) != 1 || details.Members[0] != memberID {
+		t.Errorf("details = %+v", details)
+	}
+
+	rec = get(issue(memberID), "/ws/getChatMessages/"+chatID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d; body: %s", rec.Code, rec.Body)
+	}
+	var page ws.MessagePage
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Messages == nil || len(page.Messages) != 0 {
+		t.Errorf("messages = %v, want an empty page", page.Messages)
+	}
+}
+
+func TestChatRoutesRequireToken(t *testing.T) {
+	setupRouter(t)
+
+	for _, path := range []string{"/ws/getChatMessages/" + chatID, "/ws/getChatDetails/" + chatID} {
+		if rec := get("", path); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s without a token: status = %d, want %d", path, rec.Code, http.StatusUnauthorized)
+		}
+	}
+	if testDB.ran("FROM chats") {
+		t.Error("the database was queried for an unauthenticated request")
+	}
+}
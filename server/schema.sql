@@ -5,28 +5,153 @@ CREATE TABLE IF NOT EXISTS users (
     username VARCHAR(255) NOT NULL UNIQUE,         
     email VARCHAR(255) NOT NULL UNIQUE,            
     password TEXT NOT NULL,                        
-    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMP,                        -- Timestamp of the last presence change
+    avatar_id UUID);                               -- Avatar whose variants are stored under avatars/<avatar_id>/
 
 -- Create the `chats` table
 CREATE TABLE IF NOT EXISTS chats (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(), -- Chat ID
     name VARCHAR(255),                             -- Chat name
     creator_id UUID REFERENCES users(id),          -- ID of the user who created the chat
-    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP -- Chat creation timestamp
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, -- Chat creation timestamp
+    last_seq BIGINT NOT NULL DEFAULT 0,            -- Last message sequence number
+    is_group BOOLEAN NOT NULL DEFAULT false,       -- Group chat with managed membership
+    avatar_url TEXT                                -- Group avatar
+);
+
+-- Create the `messages` table
+CREATE TABLE IF NOT EXISTS messages (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),       -- Message ID
+    chat_id UUID REFERENCES chats(id) ON DELETE CASCADE, -- Chat ID
+    sender_id UUID REFERENCES users(id),                 -- User ID of the sender
+    content TEXT NOT NULL,                               -- Message content
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,      -- Timestamp of the message
+    client_message_id VARCHAR(64),                       -- Client-generated message ID
+    seq BIGINT NOT NULL,                                 -- Per-chat message sequence number
+    edited_at TIMESTAMP,                                 -- Timestamp of the last edit
+    deleted_at TIMESTAMP,                                -- Timestamp of deletion for everyone
+    reply_to_id UUID REFERENCES messages(id) ON DELETE SET NULL, -- Message being replied to
+    kind VARCHAR(16) NOT NULL DEFAULT 'user'
+        CHECK (kind IN ('user', 'system')),              -- Message kind
+    event JSONB,                                         -- Structured event of a system message
+    search_vector TSVECTOR
+        GENERATED ALWAYS AS (to_tsvector('simple', content)) STORED, -- Searchable words of the content
+    link_urls TEXT[] NOT NULL DEFAULT '{}',              -- Previewed URLs in order of appearance
+    CONSTRAINT messages_sender_client_message_id_key UNIQUE (sender_id, client_message_id),
+    CONSTRAINT messages_chat_id_seq_key UNIQUE (chat_id, seq)
 );
 
 -- Create the `chat_members` table
 CREATE TABLE IF NOT EXISTS chat_members (
     chat_id UUID REFERENCES chats(id) ON DELETE CASCADE, -- Chat ID
     user_id UUID REFERENCES users(id),                   -- User ID
+    last_read_message UUID REFERENCES messages(id) ON DELETE SET NULL, -- Last message read
+    last_read_seq BIGINT NOT NULL DEFAULT 0,             -- Sequence number of that message
+    last_read_at TIMESTAMP,                              -- Timestamp of the last read
+    role VARCHAR(16) NOT NULL DEFAULT 'member'
+        CHECK (role IN ('owner', 'admin', 'member')),    -- Member role
     PRIMARY KEY (chat_id, user_id)                       -- Composite primary key
 );
 
--- Create the `messages` table
-CREATE TABLE IF NOT EXISTS messages (
-    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),       -- Message ID
-    chat_id UUID REFERENCES chats(id) ON DELETE CASCADE, -- Chat ID
-    sender_id UUID REFERENCES users(id),                 -- User ID of the sender
-    content TEXT NOT NULL,                               -- Message content
-    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP       -- Timestamp of the message
-);
\ No newline at end of file
+-- Speed up listing a user's chats
+CREATE INDEX IF NOT EXISTS idx_chat_members_user_id ON chat_members (user_id);
+
+-- Speed up paging through a chat's history and searching it by date
+CREATE INDEX IF NOT EXISTS idx_messages_chat_id_created_at ON messages (chat_id, created_at);
+
+-- Speed up loading threads and counting replies
+CREATE INDEX IF NOT EXISTS idx_messages_reply_to_id ON messages (reply_to_id);
+
+-- Speed up full-text message search
+CREATE INDEX IF NOT EXISTS idx_messages_search_vector ON messages USING GIN (search_vector);
+
+-- Create the `message_edits` table
+CREATE TABLE IF NOT EXISTS message_edits (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),             -- Edit ID
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE, -- Edited message
+    content TEXT NOT NULL,                                     -- Content before the edit
+    edited_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP              -- Timestamp of the edit
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_edits_message_id ON message_edits (message_id, edited_at);
+
+-- Create the `hidden_messages` table for messages deleted for a single user
+CREATE TABLE IF NOT EXISTS hidden_messages (
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE, -- Hidden message
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,       -- User who hid the message
+    hidden_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,             -- Timestamp of the deletion
+    PRIMARY KEY (user_id, message_id)                          -- Composite primary key
+);
+
+-- Create the `message_reactions` table
+CREATE TABLE IF NOT EXISTS message_reactions (
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE, -- Message reacted to
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,       -- User who reacted
+    emoji VARCHAR(32) NOT NULL,                                -- Reaction emoji
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,            -- Timestamp of the reaction
+    PRIMARY KEY (message_id, user_id, emoji)                   -- Composite primary key
+);
+
+-- Create the `attachments` table for files uploaded to chats
+CREATE TABLE IF NOT EXISTS attachments (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),                -- Attachment ID
+    chat_id UUID NOT NULL REFERENCES chats(id) ON DELETE CASCADE, -- Chat the file was uploaded to
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE,    -- Message the file is attached to, once sent
+    uploader_id UUID NOT NULL REFERENCES users(id),               -- User who uploaded the file
+    storage_key TEXT NOT NULL,                                    -- Key of the file in the storage backend
+    filename VARCHAR(255) NOT NULL,                               -- Original file name
+    content_type VARCHAR(255) NOT NULL,                           -- Sniffed MIME type
+    size BIGINT NOT NULL,                                         -- File size in bytes
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP                -- Upload timestamp
+);
+
+CREATE INDEX IF NOT EXISTS idx_attachments_message_id ON attachments (message_id);
+
+-- Create the `link_previews` table caching the metadata of linked pages
+CREATE TABLE IF NOT EXISTS link_previews (
+    url TEXT PRIMARY KEY,                                   -- Linked URL as written in messages
+    title TEXT NOT NULL DEFAULT '',                         -- Page title
+    description TEXT NOT NULL DEFAULT '',                   -- Page description
+    image_url TEXT NOT NULL DEFAULT '',                     -- Absolute URL of the preview image
+    site_name TEXT NOT NULL DEFAULT '',                     -- Name of the website
+    failed BOOLEAN NOT NULL DEFAULT FALSE,                  -- The page could not be previewed
+    fetched_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP -- When the page was last fetched
+);
+
+-- Create the `message_mentions` table for @username mentions
+CREATE TABLE IF NOT EXISTS message_mentions (
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE, -- Message containing the mention
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,       -- Mentioned member of the chat
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,            -- When the message was sent
+    PRIMARY KEY (message_id, user_id)
+);
+
+-- Speed up listing the mentions of a user
+CREATE INDEX IF NOT EXISTS idx_message_mentions_user_id ON message_mentions (user_id);
+
+-- Create the `sessions` table holding one row per issued refresh token
+CREATE TABLE IF NOT EXISTS sessions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),                 -- Refresh token ID
+    family_id UUID NOT NULL,                                       -- Sign-in the token was rotated from; the session ID users see
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,  -- Signed-in user
+    token_hash CHAR(64) NOT NULL UNIQUE,                           -- Hex SHA-256 of the refresh token
+    user_agent VARCHAR(255) NOT NULL DEFAULT '',                   -- Client that used the token
+    ip_address VARCHAR(45) NOT NULL DEFAULT '',                    -- Address the token was used from
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,       -- When the token was issued
+    expires_at TIMESTAMP NOT NULL,                                 -- When the token stops working
+    rotated_at TIMESTAMP,                                          -- When the token was exchanged for a new one
+    revoked_at TIMESTAMP                                           -- When the session was signed out
+);
+
+-- Speed up listing a user's sessions and revoking a session
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
+CREATE INDEX IF NOT EXISTS idx_sessions_family_id ON sessions (family_id);
+
+-- Create the `token_revocations` table for access tokens revoked before they expire
+CREATE TABLE IF NOT EXISTS token_revocations (
+    kind VARCHAR(16) NOT NULL CHECK (kind IN ('token', 'session')), -- Whether subject is a token ID or a session ID
+    subject UUID NOT NULL,                                          -- jti of the token, or family_id of the session
+    expires_at TIMESTAMP NOT NULL,                                  -- When every affected access token has expired
+    PRIMARY KEY (kind, subject)
+);
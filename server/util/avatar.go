@@ -0,0 +1,76 @@
+package util
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// AvatarSizes lists the square variants generated for every avatar, in pixels.
+var AvatarSizes = []int{64, 256}
+
+// DefaultAvatarSize is the variant served when no size is requested.
+const DefaultAvatarSize = 256
+
+// AvatarKey returns the storage key of an avatar variant.
+func AvatarKey(avatarID string, size int) string {
+	return fmt.Sprintf("avatars/%s/%d.png", avatarID, size)
+}
+
+// AvatarURL returns the public path of an avatar, or "" when there is none.
+// Append ?size= to request a variant other than DefaultAvatarSize.
+func AvatarURL(avatarID string) string {
+	if avatarID == "" {
+		return ""
+	}
+	return "/avatars/" + avatarID
+}
+
+// ResizeSquare crops the center square of img and scales it to size x size
+// pixels. Each target pixel averages the source pixels it covers, which keeps
+// downscaled images smooth.
+func ResizeSquare(img image.Image, size int) *image.RGBA {
+	bounds := img.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	originX := bounds.Min.X + (bounds.Dx()-side)/2
+	originY := bounds.Min.Y + (bounds.Dy()-side)/2
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		y0, y1 := span(y, side, size)
+		for x := 0; x < size; x++ {
+			x0, x1 := span(x, side, size)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					// RGBA returns alpha-premultiplied 16-bit values
+					pr, pg, pb, pa := img.At(originX+sx, originY+sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(b / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
+
+// span returns the source range covered by target pixel i when scaling side
+// pixels to size pixels. The range holds at least one pixel when upscaling.
+func span(i, side, size int) (int, int) {
+	start := i * side / size
+	end := (i + 1) * side / size
+	if end <= start {
+		end = start + 1
+	}
+	return start, end
+}
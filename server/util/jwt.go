@@ -1,21 +1,28 @@
 package util
 
 import (
-	"encoding/json"
+	"crypto"
 	"errors"
+	"fmt"
 	"log"
-	"net/http"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 
 	"server/config"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
 )
 
+// ErrTokenRevoked is returned by ValidateToken for tokens revoked on logout
+var ErrTokenRevoked = errors.New("token has been revoked")
+
 type MyJWTClaims struct {
-	ID       string `json:"id"`
-	Username string `json:"username"`
+	ID        string `json:"id"`
+	Username  string `json:"username"`
+	SessionID string `json:"sid,omitempty"` // Session the token was issued for
 	jwt.RegisteredClaims
 }
 
@@ -50,107 +57,225 @@ func (rl *RateLimiter) Allow(userID string) bool {
 	return false
 }
 
-// Global instance of RateLimiter for refresh tokens
+// Global instance of RateLimiter for refresh tokens, keyed by session
 var RefreshRateLimiter = NewRateLimiter(1 * time.Minute) // Limit to 1 refresh per minute
 
-// GenerateAccessToken generates a short-lived access token
-func GenerateAccessToken(userID, username string) (string, error) {
-	claims := MyJWTClaims{
-		ID:       userID,
-		Username: username,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(15 * time.Minute)), // 15 minutes expiry
-		},
-	}
+// TokenKey is a key access tokens are signed or verified with. Its ID is
+// sent in the kid header of the tokens signed with it. A key is either a
+// shared HS256 secret or an RS256 or EdDSA key pair.
+type TokenKey struct {
+	ID         string
+	Secret     []byte           // HS256 shared secret
+	PrivateKey crypto.Signer    // RSA or Ed25519 private key
+	PublicKey  crypto.PublicKey // For key pairs without their private key, which only verify
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(config.GetSecretKey())) // Use Access Secret Key
+// TokenIssuerOptions configures a TokenIssuer.
+type TokenIssuerOptions struct {
+	Issuer          string        // iss claim of issued tokens
+	Audience        string        // aud claim of issued tokens, required when verifying
+	AccessTokenTTL  time.Duration // Lifetime of access tokens
+	RefreshTokenTTL time.Duration // Lifetime of a session without being refreshed
+	SigningKey      TokenKey      // Key new tokens are signed with
+	// PreviousKeys are retired keys whose tokens are still accepted, so keys
+	// can be rotated without signing everyone out.
+	PreviousKeys []TokenKey
 }
 
-// GenerateRefreshToken generates a long-lived refresh token
-func GenerateRefreshToken(userID, username string) (string, error) {
-	claims := MyJWTClaims{
-		ID:       userID,
-		Username: username,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(7 * 24 * time.Hour)), // 7 days expiry
-		},
-	}
+// verificationKey is an active key and the only signing method accepted for it.
+type verificationKey struct {
+	method jwt.SigningMethod
+	key    interface{} // Secret or public key
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(config.GetRefreshSecretKey())) // Use Refresh Secret Key
+// TokenIssuer issues access tokens and verifies them against every active key.
+type TokenIssuer struct {
+	opts    TokenIssuerOptions
+	method  jwt.SigningMethod          // Method new tokens are signed with
+	signKey interface{}                // Secret or private key new tokens are signed with
+	keys    map[string]verificationKey // Active keys by kid, including the signing key
+	methods []string                   // Algorithms of the active keys
+	jwks    JWKSet                     // Public keys of the active key pairs
 }
 
-// ValidateToken validates a JWT and returns the claims
-func ValidateToken(tokenString string, isRefreshToken bool) (*MyJWTClaims, error) {
-	var secretKey string
-	if isRefreshToken {
-		secretKey = config.GetRefreshSecretKey() // Use refresh secret key
-	} else {
-		secretKey = config.GetSecretKey() // Use access secret key
+// NewTokenIssuer creates a TokenIssuer with the given options.
+func NewTokenIssuer(opts TokenIssuerOptions) (*TokenIssuer, error) {
+	if opts.AccessTokenTTL <= 0 || opts.RefreshTokenTTL <= 0 {
+		return nil, errors.New("token lifetimes must be positive")
 	}
 
-	parsedToken, err := jwt.ParseWithClaims(tokenString, &MyJWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(secretKey), nil
-	})
-	if err != nil {
-		return nil, err
+	issuer := &TokenIssuer{
+		opts: opts,
+		keys: make(map[string]verificationKey),
+		jwks: JWKSet{Keys: []JWK{}},
 	}
+	for _, key := range append([]TokenKey{opts.SigningKey}, opts.PreviousKeys...) {
+		if key.ID == "" {
+			return nil, errors.New("token keys need an ID")
+		}
+		if _, exists := issuer.keys[key.ID]; exists {
+			return nil, fmt.Errorf("duplicate token key ID %q", key.ID)
+		}
+		verifier, err := newVerificationKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("token key %q: %w", key.ID, err)
+		}
+		issuer.keys[key.ID] = verifier
 
-	claims, ok := parsedToken.Claims.(*MyJWTClaims)
-	if !ok || !parsedToken.Valid {
-		return nil, errors.New("invalid token")
+		if jwk, ok := newJWK(key.ID, verifier.key); ok {
+			issuer.jwks.Keys = append(issuer.jwks.Keys, jwk)
+		}
+		if !slices.Contains(issuer.methods, verifier.method.Alg()) {
+			issuer.methods = append(issuer.methods, verifier.method.Alg())
+		}
 	}
 
-	if claims.ExpiresAt.Time.Before(time.Now()) {
-		return nil, errors.New("token is expired")
+	switch {
+	case len(opts.SigningKey.Secret) > 0:
+		issuer.signKey = opts.SigningKey.Secret
+	case opts.SigningKey.PrivateKey != nil:
+		issuer.signKey = opts.SigningKey.PrivateKey
+	default:
+		return nil, errors.New("the signing key needs a secret or a private key")
 	}
+	issuer.method = issuer.keys[opts.SigningKey.ID].method
 
-	return claims, nil
+	return issuer, nil
 }
 
-// RefreshToken validates the refresh token and generates a new access token
-func RefreshToken(refreshToken string) (string, error) {
-	claims, err := ValidateToken(refreshToken, true) // Validate refresh token
+// newVerificationKey returns the key tokens signed with key are verified with.
+func newVerificationKey(key TokenKey) (verificationKey, error) {
+	if len(key.Secret) > 0 {
+		if key.PrivateKey != nil || key.PublicKey != nil {
+			return verificationKey{}, errors.New("a key has either a secret or a key pair")
+		}
+		return verificationKey{method: jwt.SigningMethodHS256, key: key.Secret}, nil
+	}
+
+	publicKey := key.PublicKey
+	if key.PrivateKey != nil {
+		publicKey = key.PrivateKey.Public()
+	}
+	if publicKey == nil {
+		return verificationKey{}, errors.New("a key needs a secret or a key pair")
+	}
+	method, err := publicKeyMethod(publicKey)
 	if err != nil {
-		return "", err
+		return verificationKey{}, err
 	}
+	return verificationKey{method: method, key: publicKey}, nil
+}
 
-	userID := claims.ID
+// NewTokenIssuerFromConfig creates a TokenIssuer configured from the environment.
+func NewTokenIssuerFromConfig() (*TokenIssuer, error) {
+	opts := TokenIssuerOptions{
+		Issuer:          config.GetTokenIssuer(),
+		Audience:        config.GetTokenAudience(),
+		AccessTokenTTL:  config.GetAccessTokenTTL(),
+		RefreshTokenTTL: config.GetRefreshTokenTTL(),
+		SigningKey:      TokenKey{ID: config.GetSecretKeyID(), Secret: []byte(config.GetSecretKey())},
+	}
+	if path := config.GetPrivateKeyFile(); path != "" {
+		privateKey, err := loadPrivateKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load signing key: %w", err)
+		}
+		opts.SigningKey = TokenKey{ID: config.GetSecretKeyID(), PrivateKey: privateKey}
+	}
 
-	// Check rate limiter
-	if !RefreshRateLimiter.Allow(userID) {
-		return "", errors.New("rate limit exceeded. Try again later")
+	for id, secret := range config.GetPreviousSecretKeys() {
+		opts.PreviousKeys = append(opts.PreviousKeys, TokenKey{ID: id, Secret: []byte(secret)})
+	}
+	for id, path := range config.GetPreviousPublicKeyFiles() {
+		publicKey, err := loadPublicKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load public key %q: %w", id, err)
+		}
+		opts.PreviousKeys = append(opts.PreviousKeys, TokenKey{ID: id, PublicKey: publicKey})
 	}
+	sort.Slice(opts.PreviousKeys, func(a, b int) bool {
+		return opts.PreviousKeys[a].ID < opts.PreviousKeys[b].ID
+	})
 
-	// Generate new access token
-	return GenerateAccessToken(userID, claims.Username)
+	return NewTokenIssuer(opts)
 }
 
-// RefreshTokenHandler handles token refresh requests
-func RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
-	refreshToken := r.Header.Get("Authorization")
-	if refreshToken == "" {
-		http.Error(w, "No refresh token provided", http.StatusUnauthorized)
-		return
-	}
+// JWKS returns the public keys tokens can be verified with. Shared secrets
+// are never included, so with HS256 signing the set holds no signing key.
+func (i *TokenIssuer) JWKS() JWKSet {
+	return i.jwks
+}
+
+// AccessTokenTTL returns how long issued access tokens are valid for.
+func (i *TokenIssuer) AccessTokenTTL() time.Duration {
+	return i.opts.AccessTokenTTL
+}
 
-	// Remove the "Bearer " prefix if present
-	if len(refreshToken) > 7 && refreshToken[:7] == "Bearer " {
-		refreshToken = refreshToken[7:]
+// RefreshTokenTTL returns how long a session lasts without being refreshed.
+func (i *TokenIssuer) RefreshTokenTTL() time.Duration {
+	return i.opts.RefreshTokenTTL
+}
+
+// IssueAccessToken generates a short-lived access token for a session
+func (i *TokenIssuer) IssueAccessToken(userID, username, sessionID string) (string, error) {
+	now := time.Now()
+	claims := MyJWTClaims{
+		ID:        userID,
+		Username:  username,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(), // jti, so the token can be revoked on its own
+			Issuer:    i.opts.Issuer,
+			Subject:   userID,
+			Audience:  jwt.ClaimStrings{i.opts.Audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(i.opts.AccessTokenTTL)),
+		},
 	}
 
-	newAccessToken, err := RefreshToken(refreshToken)
-	if err != nil {
-		if err.Error() == "rate limit exceeded. Try again later" {
-			http.Error(w, err.Error(), http.StatusTooManyRequests)
-		} else {
-			http.Error(w, "Invalid or expired refresh token", http.StatusUnauthorized)
+	token := jwt.NewWithClaims(i.method, claims)
+	token.Header["kid"] = i.opts.SigningKey.ID
+	return token.SignedString(i.signKey)
+}
+
+// ValidateToken validates an access token and returns the claims. The token
+// must be signed with an active key, using the algorithm of that key, and
+// carry the expected issuer and audience. Tokens on the revocation list are
+// rejected with ErrTokenRevoked.
+func (i *TokenIssuer) ValidateToken(tokenString string) (*MyJWTClaims, error) {
+	claims := &MyJWTClaims{}
+	parsedToken, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := i.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		// A public key must never be taken for an HMAC secret, or the other way round
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %q for key %q", token.Method.Alg(), kid)
 		}
-		return
+		return key.key, nil
+	}, jwt.WithValidMethods(i.methods))
+	if err != nil {
+		return nil, err
+	}
+	if !parsedToken.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	if !claims.VerifyExpiresAt(time.Now(), true) {
+		return nil, errors.New("token is expired")
+	}
+	if !claims.VerifyIssuer(i.opts.Issuer, true) {
+		return nil, errors.New("token has an unexpected issuer")
+	}
+	if !claims.VerifyAudience(i.opts.Audience, true) {
+		return nil, errors.New("token is not meant for this audience")
 	}
 
-	// Respond with the new access token
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"accessToken": newAccessToken})
+	if RevokedTokens.IsRevoked(claims) {
+		return nil, ErrTokenRevoked
+	}
+
+	return claims, nil
 }
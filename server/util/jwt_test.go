@@ -0,0 +1,299 @@
+package util
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func newTestIssuer(t *testing.T, signingKey TokenKey, previousKeys ...TokenKey) *TokenIssuer {
+	t.Helper()
+	issuer, err := NewTokenIssuer(TokenIssuerOptions{
+		Issuer:          "test",
+		Audience:        "test-api",
+		AccessTokenTTL:  time.Minute,
+		RefreshTokenTTL: time.Hour,
+		SigningKey:      signingKey,
+		PreviousKeys:    previousKeys,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issuer
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, minRSAKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newEd25519Key(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// testClaims returns valid claims for the issuer and audience of newTestIssuer.
+func testClaims() MyJWTClaims {
+	now := time.Now()
+	return MyJWTClaims{
+		ID:       "user",
+		Username: "alice",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "test",
+			Audience:  jwt.ClaimStrings{"test-api"},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		},
+	}
+}
+
+// signToken signs claims with any method and key, setting the kid header.
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims MyJWTClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestValidateTokenRoundTrip(t *testing.T) {
+	keys := []struct {
+		name string
+		key  TokenKey
+		alg  string
+	}{
+		{"HS256", TokenKey{ID: "hmac", Secret: []byte("secret")}, "HS256"},
+		{"RS256", TokenKey{ID: "rsa", PrivateKey: newRSAKey(t)}, "RS256"},
+		{"EdDSA", TokenKey{ID: "ed25519", PrivateKey: newEd25519Key(t)}, "EdDSA"},
+	}
+	for _, tt := range keys {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer := newTestIssuer(t, tt.key)
+			token, err := issuer.IssueAccessToken("user", "alice", "session")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parsed, _, err := jwt.NewParser().ParseUnverified(token, &MyJWTClaims{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.Method.Alg() != tt.alg || parsed.Header["kid"] != tt.key.ID {
+				t.Errorf("header = %v, want alg %s and kid %s", parsed.Header, tt.alg, tt.key.ID)
+			}
+
+			claims, err := issuer.ValidateToken(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.ID != "user" || claims.Username != "alice" || claims.SessionID != "session" || claims.RegisteredClaims.ID == "" {
+				t.Errorf("claims = %+v", claims)
+			}
+		})
+	}
+}
+
+func TestValidateTokenRejectsAlgorithmConfusion(t *testing.T) {
+	rsaKey := newRSAKey(t)
+	edKey := newEd25519Key(t)
+	hmacKey := TokenKey{ID: "hmac", Secret: []byte("secret")}
+
+	tests := []struct {
+		name   string
+		issuer *TokenIssuer
+		kid    string
+		public interface{}
+	}{
+		{"RSA key", newTestIssuer(t, TokenKey{ID: "rsa", PrivateKey: rsaKey}), "rsa", rsaKey.Public()},
+		{"Ed25519 key", newTestIssuer(t, TokenKey{ID: "ed25519", PrivateKey: edKey}), "ed25519", edKey.Public()},
+		// HS256 is an accepted method here, so only the per-key check stops it
+		{"RSA key next to an HMAC key", newTestIssuer(t, TokenKey{ID: "rsa", PrivateKey: rsaKey}, hmacKey), "rsa", rsaKey.Public()},
+		{"Ed25519 key next to an HMAC key", newTestIssuer(t, TokenKey{ID: "ed25519", PrivateKey: edKey}, hmacKey), "ed25519", edKey.Public()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			der, err := x509.MarshalPKIXPublicKey(tt.public)
+			if err != nil {
+				t.Fatal(err)
+			}
+			publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+			// The public key is published, so anyone can compute these HMACs
+			for _, secret := range [][]byte{publicPEM, der} {
+				token := signToken(t, jwt.SigningMethodHS256, tt.kid, secret, testClaims())
+				if _, err := tt.issuer.ValidateToken(token); err == nil {
+					t.Error("accepted an HS256 token signed with the public key")
+				}
+			}
+		})
+	}
+}
+
+func TestValidateTokenRejectsUnsignedAndUnknownKeys(t *testing.T) {
+	issuer := newTestIssuer(t, TokenKey{ID: "current", Secret: []byte("secret")})
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"alg none", signToken(t, jwt.SigningMethodNone, "current", jwt.UnsafeAllowNoneSignatureType, testClaims())},
+		{"unknown kid", signToken(t, jwt.SigningMethodHS256, "other", []byte("secret"), testClaims())},
+		{"missing kid", signToken(t, jwt.SigningMethodHS256, "", []byte("secret"), testClaims())},
+		{"wrong secret", signToken(t, jwt.SigningMethodHS256, "current", []byte("guess"), testClaims())},
+	}
+	for _, tt := range tests {
+		if _, err := issuer.ValidateToken(tt.token); err == nil {
+			t.Errorf("%s: token accepted", tt.name)
+		}
+	}
+}
+
+func TestJWKSPublishesOnlyPublicKeys(t *testing.T) {
+	rsaKey := newRSAKey(t)
+	edKey := newEd25519Key(t)
+	issuer := newTestIssuer(t,
+		TokenKey{ID: "rsa", PrivateKey: rsaKey},
+		TokenKey{ID: "hmac", Secret: []byte("hmac-secret")},
+		TokenKey{ID: "ed25519", PublicKey: edKey.Public()},
+	)
+
+	jwks := issuer.JWKS()
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("JWKS holds %d keys, want the RSA and Ed25519 keys: %+v", len(jwks.Keys), jwks.Keys)
+	}
+	for _, jwk := range jwks.Keys {
+		if jwk.KeyID == "hmac" || jwk.KeyType == "oct" || jwk.Algorithm == "HS256" {
+			t.Errorf("JWKS publishes a shared secret: %+v", jwk)
+		}
+	}
+	if got := jwks.Keys[0]; got.KeyID != "rsa" || got.KeyType != "RSA" || got.Algorithm != "RS256" || got.N == "" || got.E != "AQAB" {
+		t.Errorf("RSA key = %+v", got)
+	}
+	if got := jwks.Keys[1]; got.KeyID != "ed25519" || got.KeyType != "OKP" || got.Algorithm != "EdDSA" || got.Curve != "Ed25519" || got.X == "" {
+		t.Errorf("Ed25519 key = %+v", got)
+	}
+
+	if hmacOnly := newTestIssuer(t, TokenKey{ID: "hmac", Secret: []byte("hmac-secret")}); len(hmacOnly.JWKS().Keys) != 0 {
+		t.Errorf("JWKS of an HS256 issuer = %+v, want no keys", hmacOnly.JWKS().Keys)
+	}
+}
+
+func TestNewTokenIssuerRejectsInvalidKeys(t *testing.T) {
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		key  TokenKey
+	}{
+		{"missing ID", TokenKey{Secret: []byte("secret")}},
+		{"no key material", TokenKey{ID: "empty"}},
+		{"secret and key pair", TokenKey{ID: "both", Secret: []byte("secret"), PrivateKey: newEd25519Key(t)}},
+		{"small RSA key", TokenKey{ID: "small", PrivateKey: small}},
+	}
+	for _, tt := range tests {
+		_, err := NewTokenIssuer(TokenIssuerOptions{
+			AccessTokenTTL:  time.Minute,
+			RefreshTokenTTL: time.Hour,
+			SigningKey:      tt.key,
+		})
+		if err == nil {
+			t.Errorf("%s: key accepted", tt.name)
+		}
+	}
+
+	_, err = NewTokenIssuer(TokenIssuerOptions{
+		AccessTokenTTL:  time.Minute,
+		RefreshTokenTTL: time.Hour,
+		SigningKey:      TokenKey{ID: "same", Secret: []byte("a")},
+		PreviousKeys:    []TokenKey{{ID: "same", Secret: []byte("b")}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Errorf("duplicate key IDs: err = %v", err)
+	}
+}
+
+func TestValidateTokenAcceptsRetiredKeys(t *testing.T) {
+	rsaKey := newRSAKey(t)
+	retiredHMAC := TokenKey{ID: "2024", Secret: []byte("old-secret")}
+	retiredRSA := TokenKey{ID: "2024-rsa", PublicKey: rsaKey.Public()}
+	issuer := newTestIssuer(t, TokenKey{ID: "2025", Secret: []byte("new-secret")}, retiredHMAC, retiredRSA)
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"current key", signToken(t, jwt.SigningMethodHS256, "2025", []byte("new-secret"), testClaims()), true},
+		{"retired secret", signToken(t, jwt.SigningMethodHS256, "2024", []byte("old-secret"), testClaims()), true},
+		{"retired key pair", signToken(t, jwt.SigningMethodRS256, "2024-rsa", rsaKey, testClaims()), true},
+		{"retired kid with the current secret", signToken(t, jwt.SigningMethodHS256, "2024", []byte("new-secret"), testClaims()), false},
+		{"dropped key", signToken(t, jwt.SigningMethodHS256, "2023", []byte("older-secret"), testClaims()), false},
+	}
+	for _, tt := range tests {
+		if _, err := issuer.ValidateToken(tt.token); (err == nil) != tt.valid {
+			t.Errorf("%s: err = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+
+	// Retired keys only verify; new tokens are signed with the current key
+	token, err := issuer.IssueAccessToken("user", "alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &MyJWTClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header["kid"] != "2025" {
+		t.Errorf("kid = %v, want the signing key", parsed.Header["kid"])
+	}
+}
+
+func TestValidateTokenChecksClaims(t *testing.T) {
+	issuer := newTestIssuer(t, TokenKey{ID: "current", Secret: []byte("secret")})
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		modify func(*MyJWTClaims)
+		valid  bool
+	}{
+		{"valid", func(*MyJWTClaims) {}, true},
+		{"one of several audiences", func(c *MyJWTClaims) { c.Audience = jwt.ClaimStrings{"other-api", "test-api"} }, true},
+		{"wrong issuer", func(c *MyJWTClaims) { c.Issuer = "someone-else" }, false},
+		{"missing issuer", func(c *MyJWTClaims) { c.Issuer = "" }, false},
+		{"wrong audience", func(c *MyJWTClaims) { c.Audience = jwt.ClaimStrings{"other-api"} }, false},
+		{"missing audience", func(c *MyJWTClaims) { c.Audience = nil }, false},
+		{"expired", func(c *MyJWTClaims) { c.ExpiresAt = jwt.NewNumericDate(now.Add(-time.Second)) }, false},
+		{"missing expiry", func(c *MyJWTClaims) { c.ExpiresAt = nil }, false},
+		{"not valid yet", func(c *MyJWTClaims) { c.NotBefore = jwt.NewNumericDate(now.Add(time.Minute)) }, false},
+	}
+	for _, tt := range tests {
+		claims := testClaims()
+		tt.modify(&claims)
+		token := signToken(t, jwt.SigningMethodHS256, "current", []byte("secret"), claims)
+		if _, err := issuer.ValidateToken(token); (err == nil) != tt.valid {
+			t.Errorf("%s: err = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// RevocationList holds access tokens revoked before they expire, by token ID
+// or by session. An entry is kept until every token it covers has expired.
+type RevocationList struct {
+	mu       sync.RWMutex
+	tokens   map[string]time.Time // Token ID -> when the token expires
+	sessions map[string]time.Time // Session ID -> when its last access token expires
+}
+
+// NewRevocationList initializes an empty revocation list
+func NewRevocationList() *RevocationList {
+	return &RevocationList{
+		tokens:   make(map[string]time.Time),
+		sessions: make(map[string]time.Time),
+	}
+}
+
+// RevokeToken rejects the token with the given ID until it expires.
+func (l *RevocationList) RevokeToken(tokenID string, until time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune()
+	if until.After(time.Now()) {
+		l.tokens[tokenID] = later(l.tokens[tokenID], until)
+	}
+}
+
+// RevokeSession rejects every token issued for a session until the last of
+// them expires.
+func (l *RevocationList) RevokeSession(sessionID string, until time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune()
+	if until.After(time.Now()) {
+		l.sessions[sessionID] = later(l.sessions[sessionID], until)
+	}
+}
+
+// IsRevoked reports whether a token was revoked by its ID or its session.
+func (l *RevocationList) IsRevoked(claims *MyJWTClaims) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	now := time.Now()
+	if until, ok := l.tokens[claims.RegisteredClaims.ID]; ok && claims.RegisteredClaims.ID != "" && now.Before(until) {
+		return true
+	}
+	if until, ok := l.sessions[claims.SessionID]; ok && claims.SessionID != "" && now.Before(until) {
+		return true
+	}
+	return false
+}
+
+// prune drops the entries whose tokens have all expired. The caller must hold
+// the write lock.
+func (l *RevocationList) prune() {
+	now := time.Now()
+	for id, until := range l.tokens {
+		if !now.Before(until) {
+			delete(l.tokens, id)
+		}
+	}
+	for id, until := range l.sessions {
+		if !now.Before(until) {
+			delete(l.sessions, id)
+		}
+	}
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// Global revocation list checked by ValidateToken. Each server instance keeps
+// its own copy in memory: revocations made here apply at once, while those
+// made through other instances apply once the list is reloaded from the
+// database (at startup, then every REVOCATION_SYNC_INTERVAL).
+var RevokedTokens = NewRevocationList()